@@ -1,13 +1,50 @@
 package yamlconf
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/getlantern/deepcopy"
 	"github.com/getlantern/golog"
+	"github.com/getlantern/yaml"
+)
+
+const (
+	defaultFileMode           = 0644
+	defaultFilePollInterval   = 1 * time.Second
+	defaultHttpPollInterval   = 1 * time.Minute
+	defaultHttpPollJitter     = 0.5
+	defaultHttpRetryBaseDelay = 1 * time.Second
+	defaultHttpTimeout        = 30 * time.Second
+
+	defaultFragmentTarget = "local.yaml"
+
+	errorsBufferSize  = 10
+	changesBufferSize = 10
+
+	// maxDebounceWindows is how many ReloadDebounce windows a steady stream of
+	// file changes can delay a reload by
+	maxDebounceWindows = 10
+
+	// modTimeResolution is the coarsest modtime resolution of common file
+	// systems (FAT), within which a file can be rewritten without its modtime
+	// changing
+	modTimeResolution = 2 * time.Second
+
+	sourceDisk   = "disk"
+	sourceHttp   = "http"
+	sourceRemote = "remote"
 )
 
 var (
@@ -40,14 +77,18 @@ type Config interface {
 // 3. Using the optional HTTP config server
 // 4. Optionally specifying a custom polling mechanism (e.g. for fetching updates)
 // from a server.
+// 5. Optionally specifying an HttpURL (or other RemoteSource) from which to
+// fetch the config.
 //
 // When the file on disk is updated, Manager uses optimistic locking to make
 // sure that manual updates to the file don't overwrite intervening programmatic
 // updates. Specifically, the Config includes a Version field. Every time that
 // a programmatic update is made, the Version field is incremented. If someone
 // edits the file and then saves it, but there was an intervening programmatic
-// update, the Version in the file will not match the Version in memory, and the
-// file will be rejected and overwritten with the latest Version from memory.
+// update, the Version in the file will be older than the Version in memory, and
+// the file will be rejected and overwritten with the latest Version from memory.
+// A file with a newer Version than memory (e.g. one saved by another process)
+// is accepted.
 //
 // Programmatic updates (including ones via the HTTP config server and custom
 // polling) are processed serialy. Since these operations are all defined as
@@ -87,12 +128,140 @@ type Config interface {
 //
 //
 type Manager struct {
-	// FilePath: required, path to the config file on disk
+	// FilePath: required (unless FilePaths or FragmentDir is specified), path
+	// to the config file on disk
 	FilePath string
 
+	// FilePaths: optionally, paths to multiple config files that are merged in
+	// order to form the config. Each file is unmarshaled on top of the ones
+	// before it, so keys present in later files override those in earlier
+	// files; nested mappings are merged while sequences are replaced wholesale.
+	// A change to any of the files causes a reload. Updates are only ever
+	// written to the last (most specific) file, and FilePath is set to that
+	// file, and only the values that differ from the merge of the earlier
+	// files are written, so later changes to earlier files still take effect
+	// (unless a custom Marshal is used, in which case the whole config is
+	// written).
+	FilePaths []string
+
+	// FragmentDir: optionally, a directory of config fragments. All *.yaml
+	// files in the directory are merged in lexical order, like FilePaths, and
+	// adding, changing or removing a fragment causes a reload. Updates are
+	// written to FragmentTarget, which is always merged last, and FilePath is
+	// set to that file. As with FilePaths, only the values that differ from
+	// the other fragments are written to FragmentTarget.
+	FragmentDir string
+
+	// FragmentTarget: the name of the fragment within FragmentDir to which
+	// updates are written, defaults to "local.yaml". It is created if it
+	// doesn't exist.
+	FragmentTarget string
+
+	// ReadOnly: if true, the Manager never writes to FilePath. Defaults are
+	// still applied in memory and changes from disk or HTTP are still
+	// published, but Update() fails.
+	ReadOnly bool
+
+	// FollowSymlinks: if true and FilePath is a symlink, updates are written
+	// to the file that it points to rather than replacing the symlink with a
+	// regular file, which is useful when configs are deployed by swapping
+	// symlinks. Changes to what the symlink points to are picked up like any
+	// other change on disk.
+	FollowSymlinks bool
+
+	// FileMode: the permissions with which to write the config file, defaults
+	// to 0644.
+	FileMode os.FileMode
+
+	// StagingPath: optionally, a path to which the config is written before
+	// being promoted to FilePath. The staged file is read back and checked
+	// with Validate, and only renamed to FilePath if that succeeds; otherwise
+	// it's left in place for inspection and FilePath is untouched.
+	StagingPath string
+
+	// Fsync: if true, saving the config syncs the written file and its
+	// directory to disk, so that the new config survives a crash or power
+	// loss once saving returns. This makes saving considerably slower,
+	// especially on spinning disks and some network filesystems.
+	Fsync bool
+
+	// TempDir: optionally, the directory in which to write the temp file that
+	// is renamed to FilePath when saving, defaults to the directory of
+	// FilePath. If it's on a different filesystem, the temp file is copied to
+	// FilePath's directory and renamed into place from there.
+	TempDir string
+
+	// HistoryDir: optionally, a directory in which a copy of every saved
+	// version of the config is kept, named after FilePath with the version and
+	// time appended (e.g. config-v3-20240101T120000.yaml). See History() and
+	// PruneHistory().
+	HistoryDir string
+
+	// LockFile: if true, Init fails if another Manager (in this or another
+	// process) is already using FilePath, since the two would keep
+	// overwriting each other's changes. Otherwise, this is only logged as a
+	// warning. Detection uses an advisory lock on a file next to FilePath
+	// (with the extension .lock) that is held until the Manager is stopped.
+	LockFile bool
+
+	// FileStore: optionally, where to store the config file at FilePath
+	// instead of on disk, for example a MemoryFileStore in tests. FilePath is
+	// still required (it's used for detecting the format and in messages).
+	// Changes are picked up by polling; UseFileWatcher is ignored.
+	FileStore FileStore
+
+	// MaxConfigSize: if positive, config files larger than this many bytes are
+	// rejected rather than loaded, guarding against running out of memory
+	// because of a runaway file. YAML configs (including ones fetched
+	// remotely) that expand to more than this many nodes once aliases have
+	// been expanded are rejected too, since a small file that nests aliases
+	// can otherwise expand exponentially.
+	MaxConfigSize int64
+
+	// Cipher: optionally, a Cipher with which the config file is encrypted at
+	// rest (see NewAESGCMCipher). Configs fetched from HttpURL or a
+	// RemoteSource are expected to be unencrypted.
+	Cipher Cipher
+
 	// EmptyConfig: required, factor for new empty Configs
 	EmptyConfig func() Config
 
+	// DefaultConfigBytes: optionally, the contents (in Format) with which to
+	// create the config file if it doesn't exist yet, for example a commented
+	// starter config embedded with //go:embed. The file is written as is and
+	// only rewritten if applying defaults changes it.
+	DefaultConfigBytes []byte
+
+	// TreatEmptyAsMissing: if true, a config file that is empty or contains
+	// only whitespace (e.g. a placeholder created by a deploy tool) is treated
+	// like a missing one. On Init, it is replaced with DefaultConfigBytes and
+	// filled in with defaults. Later on, it is overwritten with the current
+	// config rather than loaded.
+	TreatEmptyAsMissing bool
+
+	// Format: the format of the config file (and of the config served at
+	// HttpURL). If unspecified, it is detected from the extension of FilePath,
+	// defaulting to YAML.
+	Format Format
+
+	// SkipSaveOnInit: if true, Init never writes the config to disk. Defaults
+	// and PerSessionSetup are still applied, but only in memory, so that files
+	// that are tracked in version control (for example) are left untouched.
+	SkipSaveOnInit bool
+
+	// Marshal and Unmarshal: optionally, functions for serializing the config
+	// in a format other than YAML and JSON (e.g. TOML). When set, they're used
+	// instead of Format for the file on disk, remote configs and snapshots.
+	// Strict has no effect on custom formats.
+	Marshal   func(cfg Config) ([]byte, error)
+	Unmarshal func(bytes []byte, cfg Config) error
+
+	// TolerateInitialSaveFailure: if true, failing to save the config in Init
+	// (e.g. because the disk is full) isn't fatal. Instead, the error is
+	// reported via Errors() and the Manager continues with the config as
+	// loaded from disk.
+	TolerateInitialSaveFailure bool
+
 	// PerSessionSetup runs at the beginning of each session (for example applying command-line
 	// flags)
 	PerSessionSetup func(currentCfg Config) error
@@ -103,74 +272,829 @@ type Manager struct {
 	// example for fetching config updates from a remote server.
 	CustomPoll func(currentCfg Config) (mutate func(cfg Config) error, waitTime time.Duration, err error)
 
-	once      sync.Once
-	cfg       Config
-	cfgMutex  sync.RWMutex
-	fileInfo  os.FileInfo
-	deltasCh  chan *delta
-	nextCfgCh chan Config
+	// EnvPrefix: optionally, a prefix for environment variables that override
+	// config fields. Any field tagged with `env:"NAME"` is set from the
+	// environment variable EnvPrefix+NAME, if present, every time the config is
+	// loaded from disk or HTTP, so the environment takes precedence over the
+	// file. Overrides are never saved: as long as a field still holds the
+	// value from the environment, the value it was loaded with is written to
+	// disk (and to HistoryDir) instead. Supported field types are string,
+	// bool, integers and time.Duration.
+	EnvPrefix string
+
+	// Interpolate: if true, placeholders like ${VAR} in config files are
+	// expanded when loading from disk, using Vars and falling back to the
+	// environment. ${VAR:-default} expands to default if VAR is unset or empty
+	// and $$ is a literal $. Any other $ (as in $5) is left as is. Since what's
+	// saved is the loaded config, saving writes the expanded values back to
+	// disk, so this is best combined with ReadOnly or SkipSaveOnInit.
+	Interpolate bool
+
+	// Vars: optionally, variables for Interpolate, which take precedence over
+	// the environment.
+	Vars map[string]string
+
+	// ErrorOnMissingVars: if true, a placeholder referring to an unset
+	// variable without a default fails loading instead of expanding to "".
+	ErrorOnMissingVars bool
+
+	// UnmanagedVersion: if true, the Manager never changes the config's
+	// version, leaving it entirely up to the user, and any change to the
+	// config (including to its version alone) counts as a change. Since the
+	// version then doesn't advance with programmatic updates, it can't be used
+	// to detect stale edits on disk, so files on disk are always accepted
+	// regardless of their version.
+	UnmanagedVersion bool
+
+	// ExternalVersion: if true, the version isn't saved in FilePath but in a
+	// separate file alongside it (FilePath + ".version"), so that the config
+	// file only contains the user's settings. A missing version file is
+	// treated as version 0.
+	ExternalVersion bool
+
+	// Migrations: optionally, functions for migrating configs loaded from disk
+	// to newer schemas, keyed by the version to which they migrate. When a
+	// config with a version lower than the highest key is loaded, every
+	// migration with a key higher than the config's version is applied in
+	// order, after which the config's version is set to the highest key. See
+	// also RegisterUpgrade.
+	Migrations map[int]func(cfg Config) error
+
+	// Strict: if true, configs loaded from disk or fetched remotely that
+	// contain unknown or duplicate keys are rejected (keeping the current
+	// config), rather than the offending keys being silently ignored.
+	Strict bool
+
+	// Lenient: if true, a config that can't be unmarshaled because of content
+	// following the first YAML document (or JSON value), such as additional
+	// documents or appended garbage, is loaded from the first document alone
+	// and a warning is logged. If the first document itself can't be
+	// unmarshaled, the config is rejected as usual. Ignored when using a custom
+	// Unmarshal.
+	Lenient bool
+
+	// EnableIncludes: if true, lines in config files of the form
+	// "key: !include path", "- !include path" or "!include path" are replaced
+	// with the contents of the file at path (relative to the including file),
+	// which may include other files in turn. Changes to included files are
+	// picked up like changes to the config file itself. Note that saving the
+	// config (e.g. on Update) writes the whole config to FilePath, replacing
+	// the directives, so includes are best used with ReadOnly.
+	EnableIncludes bool
+
+	// ApplyNestedDefaults: if true, after calling the config's ApplyDefaults(),
+	// ApplyDefaults() is also called on every value nested within the config
+	// that implements Defaulter, such as the elements of a slice of structs
+	// (see ApplyNestedDefaults()).
+	ApplyNestedDefaults bool
+
+	// Validate: optionally, a function that checks whether a config is valid.
+	// Invalid configs are never saved or published. Programmatic updates that
+	// produce an invalid config fail with the validation error, while invalid
+	// configs from disk or HTTP are logged and ignored.
+	Validate func(cfg Config) error
+
+	// Equal: optionally, a function that determines whether two configs are
+	// the same, for example ignoring fields that are computed or cached when
+	// loading (see AfterLoad). It's used to decide whether a config loaded
+	// from disk or passed to Update, Set or the remote source changed; version
+	// changes are ignored unless UnmanagedVersion is set. Defaults to
+	// reflect.DeepEqual.
+	Equal func(a, b Config) bool
+
+	// ImmutableFields: optionally, the dotted paths of fields (e.g.
+	// "Cluster.ID") that can't be changed once set to a non-zero value.
+	// Updates, configs on disk and remote configs that change any of them are
+	// rejected, keeping the current config.
+	ImmutableFields []string
+
+	// AfterLoad: optionally, a function that post-processes configs loaded
+	// from disk or fetched remotely before they become current, for example
+	// to resolve relative paths or compute derived fields. It's called after
+	// defaults and environment overrides (see EnvPrefix) are applied. If it
+	// returns an error, the loaded config is rejected and the current config
+	// is kept.
+	AfterLoad func(cfg Config) error
+
+	// BeforeSave: optionally, a function that is called with a changed config
+	// (after defaults, validation and versioning) right before it's saved, for
+	// example for auditing. It receives the very config being saved, so any
+	// changes it makes are saved (without being validated again) and become
+	// current. If it returns an error, the config is neither saved nor applied.
+	BeforeSave func(cfg Config) error
+
+	// ConflictPolicy: determines what happens when the config on disk changed
+	// while applying an update, before the change was picked up. Defaults to
+	// ConflictMerge.
+	ConflictPolicy ConflictPolicy
+
+	// RewriteOnInvalid: if true, a config on disk that can't be parsed or fails
+	// validation is overwritten with the last good config. Either way, the last
+	// good config remains current.
+	RewriteOnInvalid bool
+
+	// UseFileWatcher: if true, changes to FilePath (and any FilePaths) are
+	// detected using file system notifications rather than polling every
+	// FilePollInterval. If the files can't be watched, the Manager falls back
+	// to polling.
+	UseFileWatcher bool
+
+	// ReloadOnSignal: optionally, a signal (typically syscall.SIGHUP) upon
+	// which to reload the config from disk. The signal handler is removed when
+	// the Manager is stopped.
+	ReloadOnSignal os.Signal
+
+	// MinUpdateInterval: optionally, the minimum time between saving (and
+	// publishing) programmatic updates (see Update and Set). Updates made
+	// within this time of the last save are applied in memory right away
+	// (so Update still returns any errors and Current reflects them), but
+	// saved and published together once the time is up. Pending updates are
+	// also saved when the Manager is stopped.
+	MinUpdateInterval time.Duration
+
+	// ReloadDebounce: optionally, how long file activity detected by
+	// UseFileWatcher must settle before reloading, so that a burst of changes
+	// (e.g. an editor writing, renaming and chmod'ing the file) results in a
+	// single reload. A steady stream of changes delays reloading by at most
+	// ten times ReloadDebounce. Polling (see FilePollInterval) inherently
+	// coalesces changes and isn't debounced.
+	ReloadDebounce time.Duration
+
+	// FreshRawBytes: if true, RawBytes reads the config file every time rather
+	// than returning its contents as last loaded or saved.
+	FreshRawBytes bool
+
+	// Logger: optionally, the logger to which the Manager logs. Defaults to a
+	// logger named after FilePath (e.g. "yamlconf.config.yaml"), so that the
+	// output of several Managers can be told apart.
+	Logger golog.Logger
+
+	// Metrics: optionally, receives notifications of loads, fetches, changes
+	// and errors for monitoring.
+	Metrics Metrics
+
+	// OnChange: optionally, a function that is called whenever the config
+	// changes, with copies of the old and new configs. It is called
+	// synchronously from the Manager's processing loop, so it should return
+	// promptly.
+	OnChange func(old, new Config)
+
+	// LogChanges: if true, every change to the config is logged at debug level
+	// along with the old and new values of the changed fields (see Diff).
+	LogChanges bool
+
+	// RedactFields: optionally, dotted paths (e.g. "Auth.Token") of fields
+	// whose values are masked as *** when logging changes. Fields nested
+	// within them are masked too.
+	RedactFields []string
+
+	// FilePollInterval: how frequently to check the file on disk for changes,
+	// defaults to 1 second.
+	FilePollInterval time.Duration
+
+	// HttpURL: optionally, a URL from which to fetch the config. Whenever the
+	// config served at this URL changes, it replaces the current config (and is
+	// saved to disk).
+	HttpURL string
+
+	// HttpFallbackURLs: optionally, URLs from which to fetch the config, in
+	// order, whenever fetching from HttpURL fails (because of a connection
+	// error or a response other than 200 or 304). Their etags are tracked
+	// separately from HttpURL's and aren't persisted.
+	HttpFallbackURLs []string
+
+	// HttpMerge: if true, the config fetched from HttpURL (or RemoteSource) is
+	// merged into the current config rather than replacing it, so fields that
+	// it doesn't mention keep their current values. Fields that it does
+	// mention are overwritten even with zero values (e.g. "i: 0"), an explicit
+	// null sets pointers to nil, nested mappings are merged into existing
+	// structs and maps, and sequences are replaced wholesale.
+	HttpMerge bool
+
+	// RemoteSource: optionally, a source from which to fetch the config, for
+	// backends other than HTTP. Whenever the config it provides changes, it
+	// replaces the current config (and is saved to disk). If unspecified and
+	// HttpURL is set, the config is fetched from HttpURL. The etag of the
+	// config last fetched is persisted next to FilePath (with the extension
+	// .etag), so that restarting doesn't force a full fetch.
+	RemoteSource RemoteSource
+
+	// HttpPollInterval: how frequently to poll HttpURL (or RemoteSource),
+	// defaults to 1 minute.
+	HttpPollInterval time.Duration
+
+	// RandomizeHttpPollInterval: if true, the wait between polls of HttpURL
+	// (or RemoteSource) is randomized around HttpPollInterval, so that many
+	// clients started at the same time don't all poll at once.
+	RandomizeHttpPollInterval bool
+
+	// HttpPollJitter: when RandomizeHttpPollInterval is true, how far the wait
+	// between polls may deviate from HttpPollInterval, as a fraction (0.0 to
+	// 1.0) of HttpPollInterval. Defaults to 0.5, i.e. waits of between 50% and
+	// 150% of HttpPollInterval.
+	HttpPollJitter float64
+
+	// HttpTriggerFile: optionally, the path of a file whose appearance causes
+	// the config to be fetched from HttpURL (or RemoteSource) right away rather
+	// than at the next poll. The Manager checks for it every FilePollInterval
+	// and removes it before fetching, so that each trigger results in a single
+	// fetch.
+	HttpTriggerFile string
+
+	// RequireInitialHttpFetch: if true, Init fetches the config from HttpURL
+	// (or RemoteSource) before returning and fails if that fetch fails, so
+	// that the application never starts with a config that's only local.
+	// Otherwise, the initial fetch happens in the background. HttpTimeout and
+	// HttpMaxRetries apply to the initial fetch too.
+	RequireInitialHttpFetch bool
+
+	// HttpMaxRetries: how many times to retry a fetch from HttpURL that failed
+	// due to a connection error or 5xx response before waiting for the next
+	// poll. Defaults to 0 (no retries). Fetches are made in the background, so
+	// retrying doesn't hold up Update, Reload or Stop.
+	HttpMaxRetries int
+
+	// HttpRetryBaseDelay: how long to wait before the first retry, doubling
+	// with each subsequent retry up to HttpPollInterval. Defaults to 1 second.
+	HttpRetryBaseDelay time.Duration
+
+	// HttpTimeout: how long to wait for a response from HttpURL before giving
+	// up until the next poll, defaults to 30 seconds.
+	HttpTimeout time.Duration
+
+	// HttpVerify: optionally, a function that verifies the integrity of the
+	// (decompressed) body and headers of a response from HttpURL, for example
+	// by checking a signature. If it returns an error, the response is
+	// discarded and the current config is kept.
+	HttpVerify func(body []byte, headers http.Header) error
+
+	// HttpTransform: optionally, a function that rewrites the body of the
+	// config fetched from HttpURL (or RemoteSource) before it's unmarshaled,
+	// for example to rename legacy keys or strip an envelope. It's called
+	// after the body has been decompressed and verified. If it returns an
+	// error, the fetched config is discarded and the current config is kept.
+	HttpTransform func(body []byte) ([]byte, error)
+
+	// HttpCert: optionally, a PEM-encoded certificate to which TLS connections
+	// to HttpURL are pinned. When set, the server's certificate must chain to
+	// this certificate; the system roots are not consulted.
+	HttpCert string
+
+	// HttpProxyAddr: optionally, the address (host:port) of an HTTP proxy via
+	// which to fetch from HttpURL. The config is always fetched directly first
+	// and only via the proxy if that fails, for example because the direct
+	// path is blocked.
+	HttpProxyAddr string
+
+	once              sync.Once
+	stopOnce          sync.Once
+	cfg               Config
+	cfgMutex          sync.RWMutex
+	fileInfo          os.FileInfo
+	fileInfoAt        time.Time
+	fileHash          []byte
+	undefaulted       Config
+	envOverrides      []envOverride
+	etag              string
+	fallbackETags     map[string]string
+	absFilePath       string
+	rawBytes          []byte
+	includes          []string
+	upgrades          map[int]upgrade
+	loadedFrom        string
+	lastError         error
+	lastErrorSource   string
+	loadedAt          time.Time
+	lastHistoryTime   time.Time
+	lastModified      time.Time
+	httpClient        *http.Client
+	proxiedHttpClient *http.Client
+	watcher           *fsnotify.Watcher
+	lock              *os.File
+	signalCh          chan os.Signal
+	clock             clock
+	deltasCh          chan *delta
+	reloadCh          chan chan reloadResult
+	republishCh       chan chan struct{}
+	errorsCh          chan error
+	changesCh         chan ChangeEvent
+	nextCfgCh         <-chan Config
+	stopCh            chan struct{}
+	doneCh            chan struct{}
+	subscribers       map[int]chan Config
+	fieldSubscribers  map[int]*fieldSubscription
+	ackSubscribers    map[int]*ackSubscription
+	acksChanged       chan struct{}
+	nextSubscriberID  int
+	subscribersMutex  sync.Mutex
+	stopped           bool
+	paused            bool
+	pausedMutex       sync.RWMutex
 }
 
 type mutator func(cfg Config) error
 
-// delta is an operation that changes to the configuration
+// delta is an operation that changes to the configuration, either by mutating
+// the current config or by replacing it outright
 type delta struct {
-	mutate mutator
-	errCh  chan error
+	mutate      mutator
+	replacement Config
+	// resetVersion indicates that the config's version should be set to
+	// version rather than the next version
+	resetVersion bool
+	version      int
+	errCh        chan error
+	// result is the config resulting from the delta, set before replying on
+	// errCh
+	result Config
+}
+
+// apply applies the delta's mutator to the given config, converting any panic
+// in the mutator into an error.
+func (d *delta) apply(cfg Config) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic while applying update: %v", r)
+		}
+	}()
+	if d.mutate == nil {
+		return nil
+	}
+	return d.mutate(cfg)
+}
+
+// reloadResult is the result of reloading the config from disk
+type reloadResult struct {
+	changed bool
+	err     error
+}
+
+var (
+	errStopped   = fmt.Errorf("Manager stopped")
+	errReadOnly  = fmt.Errorf("Manager is read only")
+	errNilConfig = fmt.Errorf("EmptyConfig returned nil")
+)
+
+// logger returns the Logger to use, which is the package's logger until Init
+// sets a default.
+func (m *Manager) logger() golog.Logger {
+	if m.Logger == nil {
+		return log
+	}
+	return m.Logger
 }
 
 // Next gets the next version of the Config, blocking until the config is
-// updated.
+// updated. Once the Manager has been stopped, Next returns nil. Next is
+// implemented on top of a single subscription (see Subscribe()), so concurrent
+// callers compete for updates and a slow caller only sees the latest one.
+// Publishing never waits for Next to be called, so a slow or absent consumer
+// never holds up config processing; it may miss intermediate configs but will
+// always get the latest.
 func (m *Manager) Next() Config {
 	return <-m.nextCfgCh
 }
 
-// Update updates the config by using the given mutator function.
+// Update updates the config by using the given mutator function. Updates are
+// read-modify-write: before applying the mutator, the Manager picks up any
+// changes to the file on disk that it hasn't seen yet, so that the mutator
+// operates on the latest config and concurrent edits to the file aren't lost.
 func (m *Manager) Update(mutate func(cfg Config) error) error {
-	errCh := make(chan error)
-	m.deltasCh <- &delta{mutator(mutate), errCh}
-	return <-errCh
+	return m.submit(&delta{mutate: mutator(mutate)})
+}
+
+// UpdateAndGet is like Update, but also returns a copy of the config that
+// resulted from the update (which is the current config if the update didn't
+// change anything).
+func (m *Manager) UpdateAndGet(mutate func(cfg Config) error) (Config, error) {
+	d := &delta{mutate: mutator(mutate)}
+	if err := m.submit(d); err != nil {
+		return nil, err
+	}
+	return m.copy(d.result)
+}
+
+// Set replaces the current config with a copy of the given config. Like with
+// Update, defaults are applied and the result is validated, saved and published
+// with a new version. Setting a config identical to the current one does
+// nothing.
+func (m *Manager) Set(cfg Config) error {
+	copied, err := m.copy(cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to copy config: %s", err)
+	}
+	return m.submit(&delta{replacement: copied})
+}
+
+// ResetVersion sets the config's version to the given version, for example to
+// establish a known base after a migration. The config is saved and published
+// like with Update, and subsequent updates increment the version from there.
+func (m *Manager) ResetVersion(version int) error {
+	if version < 0 {
+		return fmt.Errorf("Version must not be negative, got %d", version)
+	}
+	return m.submit(&delta{resetVersion: true, version: version})
+}
+
+// submit submits the given delta for processing and waits for the result.
+func (m *Manager) submit(d *delta) error {
+	if m.ReadOnly {
+		return errReadOnly
+	}
+	d.errCh = make(chan error)
+	select {
+	case m.deltasCh <- d:
+		return <-d.errCh
+	case <-m.stopCh:
+		return errStopped
+	}
+}
+
+// DryRunUpdate previews the result of calling Update with the given mutator
+// function, returning the config that would result (including defaults and
+// version) without saving or publishing it. Like Update, it fails if the
+// mutator fails or panics, if Validate fails or if ImmutableFields would be
+// changed. BeforeSave isn't called.
+func (m *Manager) DryRunUpdate(mutate func(cfg Config) error) (Config, error) {
+	current := m.getCfg()
+	updated, err := m.applyDelta(&delta{mutate: mutator(mutate)}, current)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.checkUpdate(current, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// Reload immediately reloads the config from disk, returning true if it
+// changed. Reloads are processed serially with updates.
+func (m *Manager) Reload() (bool, error) {
+	resultCh := make(chan reloadResult)
+	select {
+	case m.reloadCh <- resultCh:
+		result := <-resultCh
+		return result.changed, result.err
+	case <-m.stopCh:
+		return false, errStopped
+	}
+}
+
+// Republish sends the current config to Next() and subscribers again, even
+// though it hasn't changed, for example so that they reapply it after an
+// external resource that it references changed. It doesn't change the version
+// or write anything to disk. Like updates, it's processed serially with other
+// changes.
+func (m *Manager) Republish() error {
+	doneCh := make(chan struct{})
+	select {
+	case m.republishCh <- doneCh:
+		<-doneCh
+		return nil
+	case <-m.stopCh:
+		return errStopped
+	}
+}
+
+// Errors returns a channel on which errors encountered in the background (e.g.
+// when reloading from disk or fetching from HttpURL) are delivered. Delivery is
+// best-effort: errors are dropped if the channel's buffer is full, so that a
+// slow consumer never holds up config processing. The channel is closed when
+// the Manager is stopped.
+func (m *Manager) Errors() <-chan error {
+	return m.errorsCh
+}
+
+// LastError returns the most recent background error (see Errors()), or nil if
+// the operation that failed (e.g. reloading from disk or fetching from
+// HttpURL) has since succeeded. This is useful for health checks.
+func (m *Manager) LastError() error {
+	m.cfgMutex.RLock()
+	defer m.cfgMutex.RUnlock()
+	return m.lastError
+}
+
+// reportError logs the given background error from the given source (e.g.
+// sourceDisk), remembers it for LastError() and delivers it to Errors().
+func (m *Manager) reportError(source string, err error) {
+	m.logger().Error(err)
+	m.cfgMutex.Lock()
+	m.lastError, m.lastErrorSource = err, source
+	m.cfgMutex.Unlock()
+	select {
+	case m.errorsCh <- err:
+	default:
+		m.logger().Trace("Errors channel full, dropping error")
+	}
+}
+
+// succeeded clears LastError() if it came from the given source.
+func (m *Manager) succeeded(source string) {
+	m.cfgMutex.Lock()
+	defer m.cfgMutex.Unlock()
+	if m.lastErrorSource == source {
+		m.lastError, m.lastErrorSource = nil, ""
+	}
+}
+
+// Current returns a copy of the current Config without waiting for an update.
+// It is safe to call concurrently with updates. If the config can't be copied,
+// Current returns nil.
+func (m *Manager) Current() Config {
+	copied, err := m.copy(m.getCfg())
+	if err != nil {
+		m.logger().Errorf("Unable to copy current config: %s", err)
+		return nil
+	}
+	return copied
+}
+
+// Fingerprint returns a hex-encoded SHA256 hash of the current config's
+// content, excluding its version. Configs with the same content always have the
+// same fingerprint, regardless of version or the order in which map entries were
+// added. If the config can't be hashed, Fingerprint returns "".
+func (m *Manager) Fingerprint() string {
+	b, err := m.canonicalBytes(m.getCfg())
+	if err != nil {
+		m.logger().Errorf("Unable to serialize current config: %s", err)
+		return ""
+	}
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
+
+// canonicalBytes serializes the given config's content (excluding its version)
+// in a stable form that is independent of how the config is formatted on disk
+// and of the order in which map entries were added.
+func (m *Manager) canonicalBytes(cfg Config) ([]byte, error) {
+	cfg, err := m.copy(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to copy config: %s", err)
+	}
+	cfg.SetVersion(0)
+	// encoding/json sorts map keys, making its output canonical
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		// Like encoding/json, yaml sorts map keys, but it handles some types
+		// (e.g. funcs excluded with yaml:"-") that encoding/json doesn't
+		return yaml.Marshal(cfg)
+	}
+	return b, nil
+}
+
+// ConfigFile returns the absolute path of the config file, as resolved from
+// FilePath when the Manager was initialized.
+func (m *Manager) ConfigFile() string {
+	return m.absFilePath
+}
+
+// LastLoadedFrom returns the source from which the current config was last
+// loaded, either "disk", "http" or "remote" (for a custom RemoteSource).
+// Programmatic updates don't change the source.
+func (m *Manager) LastLoadedFrom() string {
+	m.cfgMutex.RLock()
+	defer m.cfgMutex.RUnlock()
+	return m.loadedFrom
+}
+
+// LastModified returns the modification time of the config file on disk as of
+// when it was last loaded or saved.
+func (m *Manager) LastModified() time.Time {
+	m.cfgMutex.RLock()
+	defer m.cfgMutex.RUnlock()
+	return m.lastModified
+}
+
+// LoadedAt returns the time at which the current config was accepted, whether
+// it was loaded from disk or HTTP or resulted from a programmatic update.
+func (m *Manager) LoadedAt() time.Time {
+	m.cfgMutex.RLock()
+	defer m.cfgMutex.RUnlock()
+	return m.loadedAt
+}
+
+// Pause stops the Manager from reloading the config from disk or fetching it
+// remotely until Resume is called, for example so that intermediate states of
+// the file during a bulk edit aren't picked up. Update and Reload still work
+// while paused.
+func (m *Manager) Pause() {
+	m.pausedMutex.Lock()
+	defer m.pausedMutex.Unlock()
+	m.paused = true
+}
+
+// Resume undoes Pause and immediately reloads the config from disk to catch
+// up, returning any error from reloading.
+func (m *Manager) Resume() error {
+	m.pausedMutex.Lock()
+	m.paused = false
+	m.pausedMutex.Unlock()
+	_, err := m.Reload()
+	return err
+}
+
+// IsPaused indicates whether the Manager is paused (see Pause).
+func (m *Manager) IsPaused() bool {
+	m.pausedMutex.RLock()
+	defer m.pausedMutex.RUnlock()
+	return m.paused
+}
+
+// Stop stops the Manager's background processing, including any polling. Once
+// stopped, Next() returns nil and Update() returns an error. Stop waits for
+// processing to finish, including saving pending updates (see
+// MinUpdateInterval), so it must not be called from OnChange. It is safe to
+// call Stop more than once.
+func (m *Manager) Stop() {
+	if m.stopCh == nil {
+		return
+	}
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+		if m.doneCh != nil {
+			<-m.doneCh
+		}
+		m.unlockFile()
+	})
 }
 
 // Init starts the Manager, returning the initial Config (i.e. what was on
 // disk). If no config exists on disk, an empty config with ApplyDefaults() will
-// be created and saved.
+// be created and saved. An existing file is only rewritten if applying defaults
+// or PerSessionSetup changed the config (and never if SkipSaveOnInit is set), so
+// files that are already complete keep their comments and formatting.
 func (m *Manager) Init() (Config, error) {
+	cfg, _, err := m.InitWithStatus()
+	return cfg, err
+}
+
+// InitWithStatus is like Init, but additionally reports whether the config
+// file didn't exist yet and was created (e.g. for first-run onboarding).
+func (m *Manager) InitWithStatus() (Config, bool, error) {
 	if m.EmptyConfig == nil {
-		return nil, fmt.Errorf("EmptyConfig must be specified")
+		return nil, false, fmt.Errorf("EmptyConfig must be specified")
+	}
+	if err := m.checkEmptyConfig(); err != nil {
+		return nil, false, err
+	}
+	if err := m.checkUpgrades(); err != nil {
+		return nil, false, err
+	}
+	if len(m.FilePaths) > 0 {
+		m.FilePath = m.FilePaths[len(m.FilePaths)-1]
+	}
+	if m.FragmentDir != "" {
+		if m.FragmentTarget == "" {
+			m.FragmentTarget = defaultFragmentTarget
+		}
+		m.FilePath = filepath.Join(m.FragmentDir, m.FragmentTarget)
 	}
 	if m.FilePath == "" {
-		return nil, fmt.Errorf("FilePath must be specified")
+		return nil, false, fmt.Errorf("FilePath must be specified")
+	}
+	if m.Logger == nil {
+		m.Logger = golog.LoggerFor("yamlconf." + filepath.Base(m.FilePath))
+	}
+	absFilePath, err := filepath.Abs(m.FilePath)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to resolve absolute path of %s: %s", m.FilePath, err)
+	}
+	m.absFilePath = absFilePath
+	if m.FileMode == 0 {
+		m.FileMode = defaultFileMode
+	}
+	if m.Format == FormatAuto {
+		m.Format = formatFor(m.FilePath)
+	}
+	if m.FilePollInterval == 0 {
+		m.FilePollInterval = defaultFilePollInterval
+	}
+	if m.HttpPollInterval == 0 {
+		m.HttpPollInterval = defaultHttpPollInterval
+	}
+	if m.HttpTimeout == 0 {
+		m.HttpTimeout = defaultHttpTimeout
+	}
+	if m.HttpRetryBaseDelay == 0 {
+		m.HttpRetryBaseDelay = defaultHttpRetryBaseDelay
+	}
+	if _, ok := m.remoteSource().(*httpSource); ok {
+		// Only set up HTTP (including parsing HttpCert) if it's actually used
+		m.httpClient, err = m.buildHttpClient()
+		if err != nil {
+			return nil, false, err
+		}
+		if m.HttpProxyAddr != "" {
+			m.proxiedHttpClient, err = m.buildProxiedHttpClient()
+			if err != nil {
+				return nil, false, err
+			}
+		}
 	}
 	m.deltasCh = make(chan *delta)
-	m.nextCfgCh = make(chan Config)
+	m.reloadCh = make(chan chan reloadResult)
+	m.republishCh = make(chan chan struct{})
+	m.errorsCh = make(chan error, errorsBufferSize)
+	m.changesCh = make(chan ChangeEvent, changesBufferSize)
+	m.stopCh = make(chan struct{})
+	m.nextCfgCh, _ = m.Subscribe()
 
-	err := m.loadFromDisk()
+	if err := m.lockFile(); err != nil {
+		return nil, false, err
+	}
+	created, err := m.loadInitial()
 	if err != nil {
-		return nil, fmt.Errorf("Could not load config? %v", err)
+		m.unlockFile()
+		return nil, false, err
+	}
+
+	if m.remoteSource() != nil {
+		if created {
+			// The persisted etag belongs to a config that's gone
+			m.saveETag()
+		} else {
+			m.loadETag()
+		}
+		if m.RequireInitialHttpFetch {
+			if _, err := m.fetchRemoteConfig(); err != nil {
+				m.metrics().HttpError()
+				m.unlockFile()
+				return nil, false, fmt.Errorf("Unable to fetch required initial config from %s: %s", m.remoteName(), err)
+			}
+		}
+	}
+
+	if m.UseFileWatcher && m.FileStore == nil {
+		m.watcher, err = m.watchFile()
+		if err != nil {
+			m.logger().Errorf("Unable to watch %s, falling back to polling: %s", m.FilePath, err)
+		}
+	}
+
+	if m.ReloadOnSignal != nil {
+		m.signalCh = make(chan os.Signal, 1)
+		signal.Notify(m.signalCh, m.ReloadOnSignal)
+	}
+
+	m.doneCh = make(chan struct{})
+	go m.processUpdates()
+
+	return m.getCfg(), created, nil
+}
+
+// loadInitial loads the config from disk, creating it if necessary, and
+// applies the initial update, returning whether the file was created.
+func (m *Manager) loadInitial() (bool, error) {
+	created, err := m.createIfMissing()
+	if err != nil {
+		return false, err
+	}
+	err = m.loadFromDisk()
+	if err != nil {
+		return false, fmt.Errorf("Could not load config? %v", err)
 	} else {
-		log.Debugf("Loading per session setup")
+		m.logger().Debugf("Loading per session setup")
 
-		// Always save whatever we loaded, which will cause defaults to be
-		// applied and formatting to be made consistent
+		// Save whatever we loaded, which will cause defaults to be applied.
+		// This only writes to disk if the config actually changed.
 		copied, err := m.copy(m.cfg)
 		if m.PerSessionSetup != nil {
 			err := m.PerSessionSetup(copied)
 			if err != nil {
-				return nil, fmt.Errorf("Unable to perform one-time setup: %s", err)
+				return false, fmt.Errorf("Unable to perform one-time setup: %s", err)
 			}
 		}
-		if err == nil {
-			_, err = m.saveToDiskAndUpdate(copied)
+		if err == nil && m.SkipSaveOnInit {
+			m.logger().Trace("Applying initial update in memory only")
+			var changed bool
+			changed, err = m.prepareUpdate(m.cfg, copied)
+			if changed {
+				// Nothing was saved, so stay at the version on disk
+				copied.SetVersion(m.cfg.GetVersion())
+				m.setCfg(copied)
+			}
+		} else if err == nil {
+			loaded := m.cfg
+			if m.undefaulted != nil {
+				// Compare with what's on disk, so that defaults get saved
+				m.setCfg(m.undefaulted)
+			}
+			var changed bool
+			changed, err = m.saveToDiskAndUpdate(copied)
+			if !changed {
+				m.setCfg(loaded)
+			}
+			if err != nil && m.TolerateInitialSaveFailure {
+				m.reportError(sourceDisk, fmt.Errorf("Unable to perform initial update of config on disk, continuing with loaded config: %s", err))
+				err = nil
+			}
 		}
+		m.undefaulted = nil
 		if err != nil {
-			return nil, fmt.Errorf("Unable to perform initial update of config on disk: %s", err)
+			return false, fmt.Errorf("Unable to perform initial update of config on disk: %s", err)
 		}
 	}
-
-	go m.processUpdates()
-
-	return m.getCfg(), nil
+	return created, nil
 }
 
 // StartPolling starts polling if there is a custom polling function defined.
@@ -181,48 +1105,304 @@ func (m *Manager) StartPolling() {
 }
 
 func (m *Manager) processUpdates() {
+	defer close(m.doneCh)
+	defer close(m.errorsCh)
+	defer close(m.changesCh)
+	defer m.closeSubscribers()
+
+	var eventsCh <-chan fsnotify.Event
+	var watchErrorsCh <-chan error
+	if m.watcher != nil {
+		defer m.watcher.Close()
+		eventsCh, watchErrorsCh = m.watcher.Events, m.watcher.Errors
+	}
+	if m.signalCh != nil {
+		defer signal.Stop(m.signalCh)
+	}
+	var fileCh <-chan time.Time
+	if m.watcher == nil {
+		var stopFileTicker func()
+		fileCh, stopFileTicker = m.getClock().NewTicker(m.FilePollInterval)
+		defer stopFileTicker()
+	}
+
+	var debounceCh, maxDebounceCh <-chan time.Time
+
+	// While flushCh is set, updates are only applied in memory (see
+	// MinUpdateInterval). unflushed is the config before the first such
+	// update, or nil if there's nothing to flush.
+	var flushCh <-chan time.Time
+	var unflushed Config
+	defer func() {
+		if unflushed != nil {
+			m.flush(unflushed)
+		}
+	}()
+
+	var triggerCh <-chan time.Time
+	if m.remoteSource() != nil && m.HttpTriggerFile != "" {
+		var stopTriggerTicker func()
+		triggerCh, stopTriggerTicker = m.getClock().NewTicker(m.FilePollInterval)
+		defer stopTriggerTicker()
+	}
+
+	// While a fetch is in progress, fetchedCh delivers its result and httpCh
+	// is nil, so that the next poll is scheduled once the fetch is done
+	var httpCh <-chan time.Time
+	var fetchedCh chan *remoteFetch
+	if m.remoteSource() != nil {
+		if !m.RequireInitialHttpFetch {
+			// Fetch right away rather than waiting for the first tick (unless
+			// Init already did)
+			fetchedCh = m.startRemoteFetch()
+		}
+		if fetchedCh == nil {
+			httpCh = m.getClock().After(m.nextHttpPoll())
+		}
+	}
+
 	for {
-		log.Trace("Waiting for next update")
+		m.logger().Trace("Waiting for next update")
+		previous := m.cfg
 		changed := false
+		source := SourceDisk
 		select {
+		case <-m.stopCh:
+			m.logger().Debug("Stopping")
+			return
+		case <-fileCh:
+			changed = m.pollFile()
+		case event := <-eventsCh:
+			if !m.handleFileEvent(event) {
+				continue
+			}
+			if m.ReloadDebounce <= 0 {
+				changed = m.pollFile()
+				break
+			}
+			// Wait for activity to settle, but not indefinitely
+			debounceCh = m.getClock().After(m.ReloadDebounce)
+			if maxDebounceCh == nil {
+				maxDebounceCh = m.getClock().After(maxDebounceWindows * m.ReloadDebounce)
+			}
+		case <-debounceCh:
+			debounceCh, maxDebounceCh = nil, nil
+			changed = m.pollFile()
+		case <-maxDebounceCh:
+			debounceCh, maxDebounceCh = nil, nil
+			changed = m.pollFile()
+		case <-m.signalCh:
+			m.logger().Debugf("Reloading on %v", m.ReloadOnSignal)
+			changed = m.pollFile()
+		case err := <-watchErrorsCh:
+			m.reportError(sourceDisk, fmt.Errorf("Error watching %s: %s", m.FilePath, err))
+		case resultCh := <-m.reloadCh:
+			m.logger().Trace("Reload")
+			changed, err := m.reload()
+			if err == nil {
+				m.succeeded(sourceDisk)
+			}
+			if changed {
+				m.changed(SourceDisk, previous)
+			}
+			resultCh <- reloadResult{changed, err}
+			continue
+		case <-flushCh:
+			flushCh = nil
+			if unflushed != nil {
+				m.flush(unflushed)
+				unflushed = nil
+				// Keep deferring updates until they slow down
+				flushCh = m.getClock().After(m.MinUpdateInterval)
+			}
+			continue
+		case doneCh := <-m.republishCh:
+			m.logger().Trace("Republish")
+			m.publish()
+			close(doneCh)
+			continue
+		case <-httpCh:
+			httpCh = nil
+			fetchedCh = m.startRemoteFetch()
+			if fetchedCh == nil {
+				httpCh = m.getClock().After(m.nextHttpPoll())
+			}
+			continue
+		case <-triggerCh:
+			if fetchedCh != nil || !m.httpTriggered() {
+				continue
+			}
+			m.logger().Debugf("Fetching config on %s", m.HttpTriggerFile)
+			fetchedCh = m.startRemoteFetch()
+			if fetchedCh != nil {
+				httpCh = nil
+			}
+			continue
+		case fetched := <-fetchedCh:
+			fetchedCh = nil
+			changed = m.pollRemote(fetched)
+			source = SourceHTTP
+			httpCh = m.getClock().After(m.nextHttpPoll())
 		case delta := <-m.deltasCh:
-			log.Trace("Apply delta")
-			updated, err := m.copy(m.getCfg())
-			err = delta.mutate(updated)
+			m.logger().Trace("Pick up any changes on disk before applying delta")
+			base := m.cfg
+			reloaded := m.pollFile()
+			if reloaded {
+				m.changed(SourceDisk, previous)
+				previous = m.cfg
+			}
+			m.logger().Trace("Apply delta")
+			updated, err := m.deltaResult(delta, base, reloaded)
 			if err != nil {
 				delta.errCh <- err
 				continue
 			}
-			changed, err = m.saveToDiskAndUpdate(updated)
-			delta.errCh <- err
-			if err != nil {
+			if updated == nil {
+				m.logger().Debug("Discarding update in favor of change on disk")
+				delta.result = m.cfg
+				delta.errCh <- nil
+				continue
+			}
+			if delta.resetVersion {
+				changed, err = m.saveWithVersion(updated, delta.version)
+			} else if flushCh != nil {
+				changed, err = m.updateInMemory(updated)
+				if changed && unflushed == nil {
+					unflushed = previous
+				}
+				delta.result = m.cfg
+				delta.errCh <- err
 				continue
+			} else {
+				changed, err = m.saveToDiskAndUpdate(updated)
+				if changed && m.MinUpdateInterval > 0 {
+					flushCh = m.getClock().After(m.MinUpdateInterval)
+				}
 			}
+			if changed {
+				// Notify before returning so that by the time Update returns,
+				// the change has been fully processed
+				m.changed(SourceUpdate, previous)
+			}
+			delta.result = m.cfg
+			delta.errCh <- err
+			continue
 		}
 
 		if changed {
-			log.Trace("Publish changed config")
-			m.nextCfgCh <- m.cfg
+			m.changed(source, previous)
+		}
+	}
+}
+
+// flush saves updates that were only applied in memory and notifies of the
+// change from previous, the config before those updates.
+func (m *Manager) flush(previous Config) {
+	if err := m.flushUpdates(); err != nil {
+		m.reportError(sourceDisk, fmt.Errorf("Unable to save updated config: %s", err))
+	}
+	m.changed(SourceUpdate, previous)
+}
+
+// changed notifies OnChange, subscribers and Changes() that the config changed
+// from previous to the current config because of the given source.
+func (m *Manager) changed(source ChangeSource, previous Config) {
+	m.metrics().ConfigChanged()
+	m.emitChange(source, previous)
+	if m.LogChanges && previous != nil {
+		m.logChanges(previous, m.cfg)
+	}
+	if m.OnChange != nil {
+		old, err := m.copy(previous)
+		if err != nil {
+			m.logger().Errorf("Unable to copy previous config for OnChange: %s", err)
+		} else {
+			current, err := m.copy(m.cfg)
+			if err != nil {
+				m.logger().Errorf("Unable to copy current config for OnChange: %s", err)
+			} else {
+				m.OnChange(old, current)
+			}
 		}
 	}
+	m.publish()
+	m.publishFields(previous)
+}
+
+func (m *Manager) pollFile() bool {
+	if m.IsPaused() {
+		m.logger().Trace("Paused, not reloading config from disk")
+		return false
+	}
+	changed, err := m.reload()
+	if err != nil {
+		m.reportError(sourceDisk, fmt.Errorf("Unable to reload config from disk: %s", err))
+		return false
+	}
+	m.succeeded(sourceDisk)
+	return changed
+}
+
+// reload reloads the config from disk, recording metrics.
+func (m *Manager) reload() (bool, error) {
+	changed, err := m.reloadFromDisk()
+	if err != nil {
+		m.metrics().FileReloadError()
+	} else if changed {
+		m.metrics().FileReloaded()
+	}
+	return changed, err
+}
+
+// pollRemote applies the result of a fetch started with startRemoteFetch,
+// reporting whether the config changed.
+func (m *Manager) pollRemote(fetched *remoteFetch) bool {
+	changed, err := m.applyRemoteConfig(fetched)
+	if err != nil {
+		m.metrics().HttpError()
+		m.reportError(sourceRemote, fmt.Errorf("Unable to fetch config from %s: %s", m.remoteName(), err))
+		return false
+	}
+	m.succeeded(sourceRemote)
+	return changed
+}
+
+// nextHttpPoll returns how long to wait until the next poll of the remote
+// source.
+func (m *Manager) nextHttpPoll() time.Duration {
+	if !m.RandomizeHttpPollInterval {
+		return m.HttpPollInterval
+	}
+	jitter := m.HttpPollJitter
+	if jitter <= 0 {
+		jitter = defaultHttpPollJitter
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	spread := float64(m.HttpPollInterval) * jitter
+	return m.HttpPollInterval + time.Duration((rand.Float64()*2-1)*spread)
 }
 
 func (m *Manager) processCustomPolling() {
 	for {
 		waitTime := m.poll()
-		time.Sleep(waitTime)
+		select {
+		case <-m.getClock().After(waitTime):
+		case <-m.stopCh:
+			return
+		}
 	}
 }
 
 func (m *Manager) poll() time.Duration {
-	log.Debugf("Polling for new config from yamlconf")
+	m.logger().Debugf("Polling for new config from yamlconf")
 	mutate, waitTime, err := m.CustomPoll(m.getCfg())
 	if err != nil {
-		log.Errorf("Custom polling failed: %s", err)
+		m.logger().Errorf("Custom polling failed: %s", err)
 	} else {
 		err = m.Update(mutate)
 		if err != nil {
-			log.Errorf("Unable to apply update from custom polling: %s", err)
+			m.logger().Errorf("Unable to apply update from custom polling: %s", err)
 		}
 	}
 	return waitTime
@@ -232,6 +1412,13 @@ func (m *Manager) setCfg(cfg Config) {
 	m.cfgMutex.Lock()
 	defer m.cfgMutex.Unlock()
 	m.cfg = cfg
+	m.loadedAt = time.Now()
+}
+
+func (m *Manager) setLoadedFrom(source string) {
+	m.cfgMutex.Lock()
+	defer m.cfgMutex.Unlock()
+	m.loadedFrom = source
 }
 
 func (m *Manager) getCfg() Config {
@@ -240,8 +1427,60 @@ func (m *Manager) getCfg() Config {
 	return m.cfg
 }
 
+// copy deep copies the given config, falling back to a YAML round trip if
+// deepcopy can't handle it (e.g. because it contains funcs or channels,
+// which JSON doesn't support).
 func (m *Manager) copy(orig Config) (copied Config, err error) {
-	copied = m.EmptyConfig()
+	copied, err = m.newConfig()
+	if err != nil {
+		return nil, err
+	}
 	err = deepcopy.Copy(copied, orig)
-	return
+	if err == nil {
+		m.logger().Trace("Copied config using deepcopy")
+		return
+	}
+	m.logger().Tracef("Unable to copy config using deepcopy, falling back to yaml: %s", err)
+	bytes, err := yaml.Marshal(orig)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to marshal config for copying: %s", err)
+	}
+	copied, err = m.newConfig()
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(bytes, copied)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal config for copying: %s", err)
+	}
+	return copied, nil
+}
+
+// checkEmptyConfig checks that EmptyConfig returns a new config on every call,
+// since sharing a single config would leak state between loads.
+func (m *Manager) checkEmptyConfig() error {
+	a, err := m.newConfig()
+	if err != nil {
+		return err
+	}
+	b, err := m.newConfig()
+	if err != nil {
+		return err
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	// Pointers to zero-sized values may legitimately be identical
+	if va.Kind() == reflect.Ptr && va.Type() == vb.Type() && va.Type().Elem().Size() > 0 && va.Pointer() == vb.Pointer() {
+		return fmt.Errorf("EmptyConfig must return a new config on every call, but returned the same %T twice", a)
+	}
+	return nil
+}
+
+// newConfig returns a new empty config from EmptyConfig, failing if
+// EmptyConfig returns nil.
+func (m *Manager) newConfig() (Config, error) {
+	cfg := m.EmptyConfig()
+	if cfg == nil {
+		return nil, errNilConfig
+	}
+	return cfg, nil
 }
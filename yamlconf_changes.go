@@ -0,0 +1,68 @@
+package yamlconf
+
+// ChangeSource identifies what caused a change to the config.
+type ChangeSource int
+
+const (
+	// SourceUpdate is a programmatic change via Update, Set, Restore and the
+	// like.
+	SourceUpdate ChangeSource = iota
+
+	// SourceDisk is a change to the config file(s) on disk.
+	SourceDisk
+
+	// SourceHTTP is a change fetched from HttpURL (or RemoteSource).
+	SourceHTTP
+)
+
+func (s ChangeSource) String() string {
+	switch s {
+	case SourceUpdate:
+		return "update"
+	case SourceDisk:
+		return "disk"
+	case SourceHTTP:
+		return "http"
+	default:
+		return "unknown"
+	}
+}
+
+// ChangeEvent describes a single change to the config.
+type ChangeEvent struct {
+	// Source is what caused the change.
+	Source ChangeSource
+
+	// Old is the config prior to the change.
+	Old Config
+
+	// New is the config resulting from the change.
+	New Config
+
+	// Version is the version of New.
+	Version int
+}
+
+// Changes returns a channel on which a ChangeEvent is delivered for every
+// change to the config, for example for auditing. Old and New are shared with
+// the Manager and must not be modified. Like with Errors(), delivery is
+// best-effort: events are dropped if the channel's buffer is full. The channel
+// is closed when the Manager is stopped.
+func (m *Manager) Changes() <-chan ChangeEvent {
+	return m.changesCh
+}
+
+// emitChange delivers a ChangeEvent to Changes().
+func (m *Manager) emitChange(source ChangeSource, previous Config) {
+	event := ChangeEvent{
+		Source:  source,
+		Old:     previous,
+		New:     m.cfg,
+		Version: m.cfg.GetVersion(),
+	}
+	select {
+	case m.changesCh <- event:
+	default:
+		m.logger().Trace("Changes channel full, dropping change event")
+	}
+}
@@ -0,0 +1,92 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestChanges(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	defer os.Remove(file.Name() + ".etag")
+
+	source := &memorySource{}
+	source.set("n:\n  s: remote\n")
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: pollInterval,
+		RemoteSource:     source,
+		HttpPollInterval: time.Hour,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	nextChange := func() ChangeEvent {
+		select {
+		case event := <-m.Changes():
+			return event
+		case <-time.After(pollInterval * 20):
+			t.Fatal("No change event")
+			return ChangeEvent{}
+		}
+	}
+
+	event := nextChange()
+	assert.Equal(t, SourceHTTP, event.Source)
+	assert.Equal(t, "", event.Old.(*TestCfg).N.S)
+	assert.Equal(t, "remote", event.New.(*TestCfg).N.S)
+	assert.Equal(t, event.New.GetVersion(), event.Version)
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "update"
+		return nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	event = nextChange()
+	assert.Equal(t, SourceUpdate, event.Source)
+	assert.Equal(t, "remote", event.Old.(*TestCfg).N.S)
+	assert.Equal(t, "update", event.New.(*TestCfg).N.S)
+	version := event.Version
+
+	saveConfig(t, file, &TestCfg{
+		Version: version + 1,
+		N: &Nested{
+			S: "disk",
+			I: FIXED_I,
+		},
+	})
+	event = nextChange()
+	assert.Equal(t, SourceDisk, event.Source)
+	assert.Equal(t, "update", event.Old.(*TestCfg).N.S)
+	assert.Equal(t, "disk", event.New.(*TestCfg).N.S)
+	assert.Equal(t, version+1, event.Version)
+
+	m.Stop()
+	_, open := <-m.Changes()
+	assert.False(t, open, "Changes should be closed once stopped")
+}
+
+func TestChangeSourceString(t *testing.T) {
+	assert.Equal(t, "update", SourceUpdate.String())
+	assert.Equal(t, "disk", SourceDisk.String())
+	assert.Equal(t, "http", SourceHTTP.String())
+}
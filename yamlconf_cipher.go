@@ -0,0 +1,82 @@
+package yamlconf
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// Cipher encrypts and decrypts the config file at rest.
+type Cipher interface {
+	// Encrypt encrypts the given plaintext.
+	Encrypt(plaintext []byte) ([]byte, error)
+
+	// Decrypt decrypts the given ciphertext, failing if it wasn't encrypted
+	// with this Cipher.
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// NewAESGCMCipher returns a Cipher that uses AES-256 in GCM mode with the given
+// 32-byte key. Each encryption uses a random nonce, which is prepended to the
+// ciphertext.
+func NewAESGCMCipher(key []byte) (Cipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Key must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create AES cipher: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create GCM cipher: %s", err)
+	}
+	return &aesGCMCipher{aead}, nil
+}
+
+type aesGCMCipher struct {
+	aead cipher.AEAD
+}
+
+func (c *aesGCMCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c *aesGCMCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("Ciphertext too short")
+	}
+	return c.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+}
+
+// encrypt encrypts the given config file contents using Cipher, if specified.
+func (m *Manager) encrypt(bytes []byte) ([]byte, error) {
+	if m.Cipher == nil {
+		return bytes, nil
+	}
+	encrypted, err := m.Cipher.Encrypt(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encrypt config: %s", err)
+	}
+	return encrypted, nil
+}
+
+// decrypt decrypts the contents of the config file at path using Cipher, if
+// specified. An empty file is treated as an empty config.
+func (m *Manager) decrypt(path string, bytes []byte) ([]byte, error) {
+	if m.Cipher == nil || len(bytes) == 0 {
+		return bytes, nil
+	}
+	decrypted, err := m.Cipher.Decrypt(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt config from %s, it may be unencrypted or encrypted with a different key: %s", path, err)
+	}
+	return decrypted, nil
+}
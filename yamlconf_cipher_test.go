@@ -0,0 +1,116 @@
+package yamlconf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestCipherRoundTrip(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	key := bytes.Repeat([]byte{1}, 32)
+	newManager := func(key []byte) *Manager {
+		cipher, err := NewAESGCMCipher(key)
+		if err != nil {
+			t.Fatalf("Unable to create cipher: %s", err)
+		}
+		return &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath: file.Name(),
+			Cipher:   cipher,
+		}
+	}
+
+	m := newManager(key)
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "secret token"
+		return nil
+	})
+	m.Stop()
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+
+	bod, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	assert.False(t, bytes.Contains(bod, []byte("secret token")), "Config on disk should be encrypted")
+
+	m = newManager(key)
+	cfg, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.Equal(t, "secret token", cfg.(*TestCfg).N.S, "Encrypted config should be decrypted")
+}
+
+func TestCipherWrongKey(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	cipher, err := NewAESGCMCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("Unable to create cipher: %s", err)
+	}
+	encrypted, err := cipher.Encrypt([]byte("version: 1\n"))
+	if err != nil {
+		t.Fatalf("Unable to encrypt: %s", err)
+	}
+	if err := ioutil.WriteFile(file.Name(), encrypted, 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	wrongCipher, err := NewAESGCMCipher(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatalf("Unable to create cipher: %s", err)
+	}
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		Cipher:   wrongCipher,
+	}
+	err = m.loadFromDisk()
+	if assert.Error(t, err, "Loading with wrong key should fail") {
+		assert.Contains(t, err.Error(), "Unable to decrypt")
+	}
+
+	if err := ioutil.WriteFile(file.Name(), []byte("version: 1\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	err = m.loadFromDisk()
+	if assert.Error(t, err, "Loading unencrypted file should fail") {
+		assert.Contains(t, err.Error(), "Unable to decrypt")
+	}
+
+	_, err = NewAESGCMCipher([]byte("short"))
+	assert.Error(t, err, "Key of wrong length should be rejected")
+}
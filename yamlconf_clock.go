@@ -0,0 +1,35 @@
+package yamlconf
+
+import (
+	"time"
+)
+
+// clock abstracts the passage of time, so that tests can control polling
+// deterministically.
+type clock interface {
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTicker returns a channel on which the time is sent every d, along
+	// with a function for stopping the ticker.
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+func (m *Manager) getClock() clock {
+	if m.clock == nil {
+		return realClock{}
+	}
+	return m.clock
+}
@@ -0,0 +1,145 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// fakeClock is a clock that only advances when told to.
+type fakeClock struct {
+	mx      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{now: time.Now()}
+	c.cond = sync.NewCond(&c.mx)
+	return c
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	ch := c.add(d, d)
+	return ch, func() {
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		for i, w := range c.waiters {
+			if w.ch == ch {
+				c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (c *fakeClock) add(d time.Duration, period time.Duration) chan time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	c.cond.Broadcast()
+	return w.ch
+}
+
+// waitForWaiters blocks until at least n timers or tickers are pending.
+func (c *fakeClock) waitForWaiters(n int) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+// advance moves the clock forward by d, firing any timers and tickers that
+// come due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*fakeWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		select {
+		case w.ch <- c.now:
+		default:
+		}
+		if w.period > 0 {
+			w.at = c.now.Add(w.period)
+			pending = append(pending, w)
+		}
+	}
+	c.waiters = pending
+}
+
+func TestFakeClockHttpPoll(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	fetchesCh := make(chan bool, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("n:\n  s: remote\n"))
+		fetchesCh <- true
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		HttpURL:          srv.URL,
+		HttpPollInterval: 1 * time.Hour,
+		clock:            clock,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	<-fetchesCh
+	// Wait for both the file ticker and the http timer
+	clock.waitForWaiters(2)
+	select {
+	case <-fetchesCh:
+		t.Fatal("Should not poll before clock advances")
+	default:
+	}
+
+	clock.advance(1 * time.Hour)
+	select {
+	case <-fetchesCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Advancing clock should trigger http poll")
+	}
+	assert.Equal(t, "remote", m.getCfg().(*TestCfg).N.S)
+}
@@ -0,0 +1,116 @@
+package yamlconf
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ConflictPolicy determines what happens when the config on disk changed and
+// the change hasn't been picked up yet by the time an update (see Update and
+// Set) is applied.
+type ConflictPolicy int
+
+const (
+	// ConflictMerge picks up the change on disk and applies the update on top
+	// of it, so that both survive. Mutators passed to Update operate on the
+	// config from disk; of a config passed to Set, the fields that differ from
+	// the previous config are applied to the config from disk.
+	ConflictMerge ConflictPolicy = iota
+
+	// ConflictPreferMemory applies the update to the config as it was before
+	// the change on disk, overwriting the change on disk.
+	ConflictPreferMemory
+
+	// ConflictPreferDisk picks up the change on disk and discards the update.
+	ConflictPreferDisk
+
+	// ConflictError picks up the change on disk and fails the update with
+	// ErrConflict, leaving it up to the caller to retry.
+	ConflictError
+)
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictPreferMemory:
+		return "prefer memory"
+	case ConflictPreferDisk:
+		return "prefer disk"
+	case ConflictError:
+		return "error"
+	default:
+		return "merge"
+	}
+}
+
+// ErrConflict is returned by updates that conflicted with a change on disk
+// when using ConflictError.
+var ErrConflict = fmt.Errorf("Config changed on disk while updating")
+
+// deltaResult returns the config resulting from applying the given delta. If
+// conflict is true, the config on disk changed since base, the config on which
+// the update was based, and ConflictPolicy determines the result. A nil result
+// without error means that the delta should be discarded.
+func (m *Manager) deltaResult(d *delta, base Config, conflict bool) (Config, error) {
+	if !conflict {
+		return m.applyDelta(d, m.cfg)
+	}
+	m.logger().Debugf("Config changed on disk while updating, resolving conflict using %v policy", m.ConflictPolicy)
+	switch m.ConflictPolicy {
+	case ConflictPreferMemory:
+		return m.applyDelta(d, base)
+	case ConflictPreferDisk:
+		return nil, nil
+	case ConflictError:
+		return nil, ErrConflict
+	}
+	if d.replacement == nil {
+		return m.applyDelta(d, m.cfg)
+	}
+	merged, err := m.copy(m.cfg)
+	if err != nil {
+		return nil, err
+	}
+	mergeChanges(reflect.ValueOf(base), reflect.ValueOf(d.replacement), reflect.ValueOf(merged))
+	return merged, nil
+}
+
+// applyDelta applies the delta to a copy of cfg, or returns its replacement.
+func (m *Manager) applyDelta(d *delta, cfg Config) (Config, error) {
+	if d.replacement != nil {
+		return d.replacement, nil
+	}
+	updated, err := m.copy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.apply(updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// mergeChanges sets the fields of target that differ between base and updated
+// to their values in updated, recursing into structs so that changes to
+// different fields of the same struct don't conflict.
+func mergeChanges(base, updated, target reflect.Value) {
+	if reflect.DeepEqual(base.Interface(), updated.Interface()) {
+		return
+	}
+	switch base.Kind() {
+	case reflect.Ptr:
+		if !base.IsNil() && !updated.IsNil() && !target.IsNil() {
+			mergeChanges(base.Elem(), updated.Elem(), target.Elem())
+			return
+		}
+	case reflect.Struct:
+		for i := 0; i < base.NumField(); i++ {
+			if base.Type().Field(i).PkgPath != "" {
+				// Unexported
+				continue
+			}
+			mergeChanges(base.Field(i), updated.Field(i), target.Field(i))
+		}
+		return
+	}
+	target.Set(updated)
+}
@@ -0,0 +1,73 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestConflictPolicy(t *testing.T) {
+	edited := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "edited on disk",
+			I: FIXED_I,
+		},
+	}
+	for _, tc := range []struct {
+		policy      ConflictPolicy
+		set         bool
+		expectedErr error
+		expected    *TestCfg
+	}{
+		{ConflictMerge, false, nil, &TestCfg{Version: 2, N: &Nested{S: "edited on disk", I: 77}}},
+		{ConflictMerge, true, nil, &TestCfg{Version: 2, N: &Nested{S: "edited on disk", I: 77}}},
+		{ConflictPreferMemory, false, nil, &TestCfg{Version: 2, N: &Nested{S: "", I: 77}}},
+		{ConflictPreferMemory, true, nil, &TestCfg{Version: 2, N: &Nested{S: "", I: 77}}},
+		{ConflictPreferDisk, false, nil, edited},
+		{ConflictError, false, ErrConflict, edited},
+	} {
+		file, err := ioutil.TempFile("", "yamlconf_test_")
+		if err != nil {
+			t.Fatalf("Unable to create temp file: %s", err)
+		}
+		defer os.Remove(file.Name())
+
+		m := &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath: file.Name(),
+			// Make sure that polling doesn't pick up the edit first
+			FilePollInterval: 1 * time.Hour,
+			ConflictPolicy:   tc.policy,
+		}
+		initial, err := m.Init()
+		if err != nil {
+			t.Fatalf("Unable to init manager: %s", err)
+		}
+
+		// Simulate the file being edited while the update is being made
+		saveConfig(t, file, edited)
+		if tc.set {
+			replacement, err := m.copy(initial)
+			if err != nil {
+				t.Fatalf("Unable to copy config: %s", err)
+			}
+			replacement.(*TestCfg).N.I = 77
+			err = m.Set(replacement)
+		} else {
+			err = m.Update(func(cfg Config) error {
+				cfg.(*TestCfg).N.I = 77
+				return nil
+			})
+		}
+		assert.Equal(t, tc.expectedErr, err, "%v (set: %v)", tc.policy, tc.set)
+		assert.Equal(t, tc.expected, m.getCfg(), "%v (set: %v)", tc.policy, tc.set)
+		assertSavedConfigEquals(t, file, tc.expected)
+		m.Stop()
+	}
+}
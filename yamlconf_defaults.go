@@ -0,0 +1,192 @@
+package yamlconf
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ApplyDefaultsFromTags fills in unset fields of the given config from their
+// `default:"..."` struct tags. It is intended to be called from a Config's
+// ApplyDefaults() method.
+//
+// Only fields that can represent "unset" are filled, so that explicitly set
+// zero values are left alone:
+//
+//   - nil pointers to strings, bools, integers or time.Durations are set to
+//     the tag's value
+//   - maps from strings to such values get any keys that are missing from the
+//     tag's comma-separated list of key=value pairs (e.g. `default:"a=1,b=2"`)
+//
+// Nested structs are processed recursively, and nil pointers to structs that
+// contain default tags are allocated so that their defaults apply, unless they
+// point to a struct that is already being processed (as in linked lists).
+func ApplyDefaultsFromTags(cfg Config) error {
+	return applyDefaults(reflect.ValueOf(cfg), make(map[reflect.Type]bool))
+}
+
+// applyDefaults applies defaults to v. visiting holds the struct types on the
+// path to v, so that recursive types don't cause endless allocation.
+func applyDefaults(v reflect.Value, visiting map[reflect.Type]bool) error {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	t := v.Type()
+	visiting[t] = true
+	defer delete(visiting, t)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		fv := v.Field(i)
+		def, hasDefault := field.Tag.Lookup("default")
+		if !hasDefault {
+			if fv.Kind() == reflect.Ptr && fv.IsNil() && !visiting[fv.Type().Elem()] && hasDefaults(fv.Type().Elem(), make(map[reflect.Type]bool)) {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			if err := applyDefaults(fv, visiting); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var err error
+		switch fv.Kind() {
+		case reflect.Ptr:
+			if fv.IsNil() {
+				value := reflect.New(fv.Type().Elem())
+				err = setFromString(value.Elem(), def)
+				if err == nil {
+					fv.Set(value)
+				}
+			}
+		case reflect.Map:
+			err = applyMapDefaults(fv, def)
+		default:
+			err = fmt.Errorf("only pointer and map fields can have defaults")
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to apply default for %s: %s", field.Name, err)
+		}
+	}
+	return nil
+}
+
+func applyMapDefaults(m reflect.Value, def string) error {
+	if m.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("only maps with string keys can have defaults")
+	}
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+	for _, pair := range strings.Split(def, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		key := reflect.ValueOf(parts[0]).Convert(m.Type().Key())
+		if m.MapIndex(key).IsValid() {
+			continue
+		}
+		value := reflect.New(m.Type().Elem()).Elem()
+		if err := setFromString(value, parts[1]); err != nil {
+			return err
+		}
+		m.SetMapIndex(key, value)
+	}
+	return nil
+}
+
+// hasDefaults determines whether the given struct type (or any struct nested
+// within it) has fields with default tags. seen holds the types already
+// checked, which are skipped to handle recursive types.
+func hasDefaults(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t.Kind() != reflect.Struct || seen[t] {
+		return false
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if _, found := field.Tag.Lookup("default"); found {
+			return true
+		}
+		ft := field.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if hasDefaults(ft, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// Defaulter is implemented by types that fill in their own defaults, like
+// Config.
+type Defaulter interface {
+	ApplyDefaults()
+}
+
+// ApplyNestedDefaults calls ApplyDefaults() on every Defaulter nested within
+// the given config, at any depth: in struct fields and in the elements of
+// slices, arrays and maps. The config's own ApplyDefaults() isn't called. Each
+// value's defaults are applied before those of the values nested within it.
+func ApplyNestedDefaults(cfg Config) {
+	applyNestedDefaults(reflect.ValueOf(cfg))
+}
+
+func applyNestedDefaults(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			applyNestedDefaults(v.Elem())
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				// unexported
+				continue
+			}
+			applyDefaultsTo(v.Field(i))
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			applyDefaultsTo(v.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// Map values aren't addressable, so work on a copy and put it back
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			applyDefaultsTo(value)
+			v.SetMapIndex(key, value)
+		}
+	}
+}
+
+// applyDefaultsTo applies defaults to the given value, if it's a Defaulter, and
+// to the values nested within it.
+func applyDefaultsTo(v reflect.Value) {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return
+	}
+	target := v
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface && v.CanAddr() {
+		// Allow for ApplyDefaults() having a pointer receiver
+		target = v.Addr()
+	}
+	if d, ok := target.Interface().(Defaulter); ok {
+		d.ApplyDefaults()
+	}
+	applyNestedDefaults(v)
+}
@@ -0,0 +1,203 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/yaml"
+)
+
+type DefaultsCfg struct {
+	Version int
+	I       *int           `default:"55"`
+	S       *string        `default:"hello"`
+	D       *time.Duration `default:"5s"`
+	Ports   map[string]int `default:"http=80,https=443"`
+	N       *DefaultsNested
+}
+
+type DefaultsNested struct {
+	B *bool `default:"true"`
+}
+
+func (c *DefaultsCfg) GetVersion() int {
+	return c.Version
+}
+
+func (c *DefaultsCfg) SetVersion(version int) {
+	c.Version = version
+}
+
+func (c *DefaultsCfg) ApplyDefaults() {
+	if err := ApplyDefaultsFromTags(c); err != nil {
+		panic(err)
+	}
+}
+
+func TestApplyDefaultsFromTags(t *testing.T) {
+	cfg := &DefaultsCfg{}
+	cfg.ApplyDefaults()
+	assert.Equal(t, 55, *cfg.I)
+	assert.Equal(t, "hello", *cfg.S)
+	assert.Equal(t, 5*time.Second, *cfg.D)
+	assert.Equal(t, map[string]int{"http": 80, "https": 443}, cfg.Ports)
+	if assert.NotNil(t, cfg.N, "Nested struct with defaults should be allocated") {
+		assert.True(t, *cfg.N.B)
+	}
+}
+
+func TestApplyDefaultsFromTagsKeepsExplicitZeros(t *testing.T) {
+	zero := 0
+	empty := ""
+	no := false
+	cfg := &DefaultsCfg{
+		I:     &zero,
+		S:     &empty,
+		Ports: map[string]int{"http": 0},
+		N:     &DefaultsNested{B: &no},
+	}
+	cfg.ApplyDefaults()
+	assert.Equal(t, 0, *cfg.I, "Explicit zero should not be overwritten")
+	assert.Equal(t, "", *cfg.S, "Explicit empty string should not be overwritten")
+	assert.Equal(t, map[string]int{"http": 0, "https": 443}, cfg.Ports, "Only missing keys should be filled")
+	assert.False(t, *cfg.N.B, "Explicit false should not be overwritten")
+}
+
+func TestApplyDefaultsFromTagsYAML(t *testing.T) {
+	cfg := &DefaultsCfg{}
+	if err := yaml.Unmarshal([]byte("i: 0\n"), cfg); err != nil {
+		t.Fatalf("Unable to unmarshal: %s", err)
+	}
+	cfg.ApplyDefaults()
+	assert.Equal(t, 0, *cfg.I, "Zero set in yaml should not be overwritten")
+	assert.Equal(t, "hello", *cfg.S, "Field missing from yaml should get default")
+}
+
+func TestApplyDefaultsFromTagsInvalid(t *testing.T) {
+	type BadCfg struct {
+		DefaultsCfg
+		X int `default:"1"`
+	}
+	assert.Error(t, ApplyDefaultsFromTags(&BadCfg{}), "Non-pointer field with default should fail")
+}
+
+type RecursiveCfg struct {
+	Version int
+	Head    *Node
+}
+
+type Node struct {
+	X      *int `default:"1"`
+	Next   *Node
+	Branch *Branch
+}
+
+type Branch struct {
+	Y    *int `default:"2"`
+	Back *Node
+}
+
+func (c *RecursiveCfg) GetVersion() int {
+	return c.Version
+}
+
+func (c *RecursiveCfg) SetVersion(version int) {
+	c.Version = version
+}
+
+func (c *RecursiveCfg) ApplyDefaults() {}
+
+func TestApplyDefaultsFromTagsRecursive(t *testing.T) {
+	cfg := &RecursiveCfg{}
+	if assert.NoError(t, ApplyDefaultsFromTags(cfg)) && assert.NotNil(t, cfg.Head) {
+		assert.Equal(t, 1, *cfg.Head.X)
+		assert.Nil(t, cfg.Head.Next, "Pointer to type being processed should not be allocated")
+		if assert.NotNil(t, cfg.Head.Branch, "Pointer to other type with defaults should be allocated") {
+			assert.Equal(t, 2, *cfg.Head.Branch.Y)
+			assert.Nil(t, cfg.Head.Branch.Back, "Pointer to type being processed should not be allocated")
+		}
+	}
+
+	cfg = &RecursiveCfg{Head: &Node{Next: &Node{}}}
+	if assert.NoError(t, ApplyDefaultsFromTags(cfg)) {
+		assert.Equal(t, 1, *cfg.Head.Next.X, "Existing recursive values should get defaults")
+		assert.Nil(t, cfg.Head.Next.Next)
+	}
+}
+
+type ProxiesCfg struct {
+	Version int
+	Proxies []Proxy
+	ByName  map[string]*Proxy
+	Backups map[string]Proxy
+}
+
+type Proxy struct {
+	Addr string
+	Port int
+}
+
+func (p *Proxy) ApplyDefaults() {
+	if p.Port == 0 {
+		p.Port = 443
+	}
+}
+
+func (c *ProxiesCfg) GetVersion() int {
+	return c.Version
+}
+
+func (c *ProxiesCfg) SetVersion(version int) {
+	c.Version = version
+}
+
+func (c *ProxiesCfg) ApplyDefaults() {
+}
+
+func TestApplyNestedDefaults(t *testing.T) {
+	cfg := &ProxiesCfg{
+		Proxies: []Proxy{{Addr: "a"}, {Addr: "b", Port: 80}},
+		ByName:  map[string]*Proxy{"c": {Addr: "c"}, "nil": nil},
+		Backups: map[string]Proxy{"d": {Addr: "d"}},
+	}
+	ApplyNestedDefaults(cfg)
+	assert.Equal(t, &ProxiesCfg{
+		Proxies: []Proxy{{Addr: "a", Port: 443}, {Addr: "b", Port: 80}},
+		ByName:  map[string]*Proxy{"c": {Addr: "c", Port: 443}, "nil": nil},
+		Backups: map[string]Proxy{"d": {Addr: "d", Port: 443}},
+	}, cfg)
+}
+
+func TestManagerApplyNestedDefaults(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &ProxiesCfg{}
+		},
+		FilePath:            file.Name(),
+		ApplyNestedDefaults: true,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		pc := cfg.(*ProxiesCfg)
+		pc.Proxies = append(pc.Proxies, Proxy{Addr: "a"}, Proxy{Addr: "b"})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	assert.Equal(t, []Proxy{{Addr: "a", Port: 443}, {Addr: "b", Port: 443}}, m.getCfg().(*ProxiesCfg).Proxies, "Each element should get defaults")
+}
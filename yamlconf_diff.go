@@ -0,0 +1,110 @@
+package yamlconf
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Diff returns the dotted paths (e.g. "N.S") of the exported fields that differ
+// between old and new, which must be non-nil Configs of the same type. The
+// top-level Version field is ignored. Structs and pointers to structs are
+// compared field by field; a pointer that is nil on only one side is reported
+// as a single path. Other values (slices, maps, etc.) are compared as a whole.
+func Diff(old, new Config) []string {
+	var paths []string
+	diff(reflect.ValueOf(old), reflect.ValueOf(new), "", &paths)
+	return paths
+}
+
+func diff(a, b reflect.Value, path string, paths *[]string) {
+	if a.Kind() == reflect.Ptr && b.Kind() == reflect.Ptr {
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				*paths = append(*paths, path)
+			}
+			return
+		}
+		diff(a.Elem(), b.Elem(), path, paths)
+		return
+	}
+
+	if a.Kind() == reflect.Struct && a.Type() == b.Type() {
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				// unexported
+				continue
+			}
+			if path == "" && field.Name == "Version" {
+				continue
+			}
+			diff(a.Field(i), b.Field(i), joinPath(path, field.Name), paths)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+		*paths = append(*paths, path)
+	}
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// logChanges logs the fields that differ between old and new along with their
+// values, masking the values of RedactFields.
+func (m *Manager) logChanges(old, new Config) {
+	for _, path := range Diff(old, new) {
+		if m.isRedacted(path) {
+			m.logger().Debugf("Config changed at %s: *** -> ***", path)
+			continue
+		}
+		m.logger().Debugf("Config changed at %s: %v -> %v", path, valueAt(old, path), valueAt(new, path))
+	}
+}
+
+// isRedacted determines whether the value at the given path is or contains one
+// of RedactFields.
+func (m *Manager) isRedacted(path string) bool {
+	for _, redacted := range m.RedactFields {
+		if path == "" || path == redacted || strings.HasPrefix(path, redacted+".") || strings.HasPrefix(redacted, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// valueAt returns the value of the field at the given dotted path in cfg, or
+// nil if there is no such value (e.g. because of a nil pointer along the way).
+func valueAt(cfg Config, path string) interface{} {
+	v := reflect.ValueOf(cfg)
+	if path != "" {
+		for _, name := range strings.Split(path, ".") {
+			for v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					return nil
+				}
+				v = v.Elem()
+			}
+			if v.Kind() != reflect.Struct {
+				return nil
+			}
+			v = v.FieldByName(name)
+			if !v.IsValid() {
+				return nil
+			}
+		}
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	return v.Interface()
+}
@@ -0,0 +1,107 @@
+package yamlconf
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	base := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "a",
+			I: 1,
+		},
+	}
+
+	assert.Empty(t, Diff(base, &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "a",
+			I: 1,
+		},
+	}), "Version change alone should not be reported")
+
+	assert.Equal(t, []string{"N.S"}, Diff(base, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "b",
+			I: 1,
+		},
+	}), "Changed nested field should be reported")
+
+	assert.Equal(t, []string{"N.S", "N.I"}, Diff(base, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "b",
+			I: 2,
+		},
+	}), "All changed nested fields should be reported")
+
+	assert.Equal(t, []string{"N"}, Diff(&TestCfg{}, base), "Added pointer should be reported")
+}
+
+// lockedBuffer is a bytes.Buffer that's safe for concurrent use, since other
+// Managers may log in the background while capturing log output.
+type lockedBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+func TestLogChanges(t *testing.T) {
+	out := &lockedBuffer{}
+	golog.SetOutputs(out, out)
+	defer golog.ResetOutputs()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		LogChanges:   true,
+		RedactFields: []string{"N.S"},
+	}
+	m.cfg = &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "new secret",
+			I: 2,
+		},
+	}
+	m.changed(SourceUpdate, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "old secret",
+			I: 1,
+		},
+	})
+	logged := out.String()
+	assert.Contains(t, logged, "Config changed at N.I: 1 -> 2")
+	assert.Contains(t, logged, "Config changed at N.S: *** -> ***")
+	assert.False(t, strings.Contains(logged, "secret"), "Redacted values should not be logged")
+
+	m.changed(SourceUpdate, &TestCfg{Version: 1})
+	logged = out.String()
+	assert.Contains(t, logged, "Config changed at N: *** -> ***", "Fields containing redacted fields should be masked")
+	assert.False(t, strings.Contains(logged, "secret"), "Redacted values should not be logged")
+
+	m.RedactFields = nil
+	m.changed(SourceUpdate, &TestCfg{Version: 1})
+	assert.Contains(t, out.String(), "Config changed at N: <nil> -> {new secret 2}")
+}
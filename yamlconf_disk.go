@@ -1,12 +1,16 @@
 package yamlconf
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"reflect"
-
-	"github.com/getlantern/yaml"
+	"time"
 )
 
 func (m *Manager) loadFromDisk() error {
@@ -14,111 +18,620 @@ func (m *Manager) loadFromDisk() error {
 	return err
 }
 
+// createIfMissing creates a config file at FilePath containing
+// DefaultConfigBytes (empty by default) if there isn't one yet (or, with
+// TreatEmptyAsMissing, if it's blank), returning true if it did. The new file
+// is then loaded like any other and filled in with defaults.
+func (m *Manager) createIfMissing() (bool, error) {
+	if m.ReadOnly {
+		return false, nil
+	}
+	_, err := m.fileStore().Stat()
+	if err == nil && m.TreatEmptyAsMissing {
+		data, err := m.fileStore().Read()
+		if err != nil || !isBlank(data) {
+			// Read errors are reported when loading
+			return false, nil
+		}
+		m.logger().Debugf("Config at %s is empty, replacing it", m.FilePath)
+	} else if err == nil || !os.IsNotExist(err) {
+		// Anything other than a missing file is reported when loading
+		return false, nil
+	} else {
+		m.logger().Debugf("No config at %s, creating one", m.FilePath)
+	}
+	bytes, err := m.encrypt(m.DefaultConfigBytes)
+	if err != nil {
+		return false, err
+	}
+	if err := m.fileStore().Write(bytes); err != nil {
+		return false, fmt.Errorf("Unable to create config file %s: %s", m.FilePath, err)
+	}
+	return true, nil
+}
+
+// filePaths returns the paths of all files making up the config, in the order
+// in which they're merged.
+func (m *Manager) filePaths() ([]string, error) {
+	if m.FragmentDir != "" {
+		return m.fragmentPaths()
+	}
+	if len(m.FilePaths) > 0 {
+		return m.FilePaths, nil
+	}
+	return []string{m.FilePath}, nil
+}
+
+// fragmentPaths returns the paths of all fragments in FragmentDir in lexical
+// order, followed by FilePath (the target fragment).
+func (m *Manager) fragmentPaths() ([]string, error) {
+	infos, err := ioutil.ReadDir(m.FragmentDir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list fragments in %s: %s", m.FragmentDir, err)
+	}
+	var paths []string
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != ".yaml" || info.Name() == m.FragmentTarget {
+			continue
+		}
+		paths = append(paths, filepath.Join(m.FragmentDir, info.Name()))
+	}
+	return append(paths, m.FilePath), nil
+}
+
 func (m *Manager) reloadFromDisk() (bool, error) {
-	cfg := m.EmptyConfig()
+	cfg, err := m.newConfig()
+	if err != nil {
+		return false, err
+	}
 
-	fileInfo, err := os.Stat(m.FilePath)
+	fileInfo, err := m.fileStore().Stat()
 	if err != nil {
 		return false, fmt.Errorf("Unable to stat config file %s: %s", m.FilePath, err)
 	}
-	if m.fileInfo == fileInfo {
-		log.Trace("Config unchanged on disk")
+	paths, err := m.filePaths()
+	if err != nil {
+		return false, err
+	}
+	if len(paths) == 1 && len(m.includes) == 0 && m.fileInfo != nil && !m.modTimeRacy() && os.SameFile(m.fileInfo, fileInfo) &&
+		fileInfo.Size() == m.fileInfo.Size() && fileInfo.ModTime().Equal(m.fileInfo.ModTime()) {
+		m.logger().Trace("Config unchanged on disk")
 		return false, nil
 	}
-	bytes, err := ioutil.ReadFile(m.FilePath)
-	if err != nil {
-		return false, fmt.Errorf("Error reading config from %s: %s", m.FilePath, err)
+
+	contents := make([][]byte, 0, len(paths))
+	hash := sha256.New()
+	for _, path := range paths {
+		data, err := m.readFile(path)
+		if err != nil {
+			return false, err
+		}
+		if path == m.FilePath && m.TreatEmptyAsMissing && m.cfg != nil && isBlank(data) {
+			return false, m.restoreEmpty()
+		}
+		// Include the path so that adding or removing files is noticed
+		fmt.Fprintf(hash, "%s:%d:", path, len(data))
+		hash.Write(data)
+		contents = append(contents, data)
 	}
-	err = yaml.Unmarshal(bytes, cfg)
-	if err != nil {
-		return false, fmt.Errorf("Error unmarshaling config yaml from %s: %s", m.FilePath, err)
+	for _, path := range m.includes {
+		// Changes to included files count as changes too. If an include was
+		// removed, resolving includes below reports it.
+		data, _ := m.readPath(path)
+		fmt.Fprintf(hash, "%s:%d:", path, len(data))
+		hash.Write(data)
+	}
+	fileHash := hash.Sum(nil)
+	if m.fileHash != nil && bytes.Equal(fileHash, m.fileHash) {
+		m.logger().Trace("Config contents unchanged on disk")
+		m.setFileInfo(fileInfo)
+		return false, nil
+	}
+
+	var included []string
+	var raw []byte
+	for i, path := range paths {
+		data, err := m.decrypt(path, contents[i])
+		if err != nil {
+			return false, err
+		}
+		if path == m.FilePath {
+			raw = data
+		}
+		if m.EnableIncludes {
+			data, err = m.resolveIncludes(path, data, &included)
+			if err != nil {
+				return false, m.rejectInvalid(err)
+			}
+		}
+		data, err = m.interpolate(data)
+		if err != nil {
+			return false, fmt.Errorf("Unable to interpolate config from %s: %s", path, err)
+		}
+		if err := m.checkStrict(data, cfg); err != nil {
+			return false, m.rejectInvalid(fmt.Errorf("Invalid config in %s: %s", path, err))
+		}
+		// Unmarshaling each file on top of the previous ones merges them
+		err = m.unmarshal(data, cfg)
+		if err != nil {
+			return false, m.rejectInvalid(newParseError(path, data, err))
+		}
+	}
+	m.setIncludes(included)
+	if m.ExternalVersion {
+		version, err := m.readExternalVersion()
+		if err != nil {
+			return false, err
+		}
+		cfg.SetVersion(version)
+	}
+	if err := m.applyEnv(cfg); err != nil {
+		return false, err
+	}
+	if m.cfg == nil {
+		// Remember what was on disk, so that Init can tell whether applying
+		// defaults changed it (see loadInitial)
+		loaded, err := m.copy(cfg)
+		if err != nil {
+			return false, err
+		}
+		m.applyDefaults(cfg)
+		if !m.equal(loaded, cfg) {
+			m.undefaulted = loaded
+		}
+	} else {
+		m.applyDefaults(cfg)
+	}
+	if err := m.afterLoad(cfg); err != nil {
+		return false, m.rejectInvalid(fmt.Errorf("Config on disk at %s was rejected, keeping current config: %s", m.FilePath, err))
 	}
 
-	if m.cfg != nil && m.cfg.GetVersion() != cfg.GetVersion() {
-		log.Trace("Version mismatch on disk, overwriting what's on disk with current version")
+	if m.ReadOnly && m.cfg != nil {
+		// The version on disk never advances in read only mode, so rather than
+		// comparing versions, treat the file's contents as an update
+		changed, err := m.saveToDiskAndUpdate(cfg)
+		if err != nil {
+			return false, err
+		}
+		if changed {
+			m.setLoadedFrom(sourceDisk)
+		}
+		m.setRawBytes(raw)
+		m.recordLoaded(fileInfo, fileHash)
+		return changed, nil
+	}
+
+	if !m.UnmanagedVersion && m.cfg != nil && cfg.GetVersion() < m.cfg.GetVersion() {
+		m.logger().Trace("Stale version on disk, overwriting what's on disk with current version")
 		if err := m.writeToDisk(m.cfg); err != nil {
-			log.Errorf("Unable to write to disk: %v", err)
+			m.logger().Errorf("Unable to write to disk: %v", err)
 		}
-		return false, fmt.Errorf("Version of config on disk did not match expected. Expected %d, found %d", m.cfg.GetVersion(), cfg.GetVersion())
+		return false, fmt.Errorf("Version of config on disk was older than expected. Expected %d, found %d", m.cfg.GetVersion(), cfg.GetVersion())
+	}
+
+	cfg, migrated, err := m.migrate(cfg)
+	if err != nil {
+		return false, fmt.Errorf("Unable to migrate config from %s, keeping current config: %s", m.FilePath, err)
 	}
 
-	if reflect.DeepEqual(m.cfg, cfg) {
-		log.Trace("Config on disk is same as in memory, ignoring")
+	if m.equal(m.cfg, cfg) {
+		m.logger().Trace("Config on disk is same as in memory, ignoring")
+		m.setRawBytes(raw)
+		m.recordLoaded(fileInfo, fileHash)
 		return false, nil
 	}
 
-	log.Debugf("Configuration changed on disk, applying")
+	if err := m.validate(cfg); err != nil {
+		return false, m.rejectInvalid(fmt.Errorf("Config on disk at %s is invalid, keeping current config: %s", m.FilePath, err))
+	}
+	if err := m.checkImmutable(m.cfg, cfg); err != nil {
+		return false, m.rejectInvalid(fmt.Errorf("Config on disk at %s was rejected, keeping current config: %s", m.FilePath, err))
+	}
+
+	m.logger().Debugf("Configuration changed on disk, applying")
+
+	if migrated {
+		m.logger().Debugf("Saving migrated config")
+		if err := m.writeToDisk(cfg); err != nil {
+			return false, err
+		}
+		// What's on disk now includes the defaults
+		m.undefaulted = nil
+		// The file now differs from what we read, so don't record it as
+		// loaded and let the next reload pick up what we wrote
+		fileInfo, fileHash = m.fileInfo, nil
+	}
 
 	m.setCfg(cfg)
-	m.fileInfo = fileInfo
+	m.setLoadedFrom(sourceDisk)
+	if !migrated {
+		// Otherwise, writeToDisk already recorded what it wrote
+		m.setRawBytes(raw)
+	}
+	m.recordLoaded(fileInfo, fileHash)
 
 	return true, nil
 }
 
+// restoreEmpty overwrites the blank file at FilePath with the current config,
+// instead of loading it and wiping the config.
+func (m *Manager) restoreEmpty() error {
+	m.logger().Debugf("Config at %s is empty, writing current config", m.FilePath)
+	if err := m.writeToDisk(m.cfg); err != nil {
+		return fmt.Errorf("Unable to replace empty config file %s: %s", m.FilePath, err)
+	}
+	return nil
+}
+
+// isBlank returns true if data is empty or contains only whitespace.
+func isBlank(data []byte) bool {
+	return len(bytes.TrimSpace(data)) == 0
+}
+
+// readFile reads the config file at the given path, going through the
+// FileStore for FilePath and enforcing MaxConfigSize.
+func (m *Manager) readFile(path string) ([]byte, error) {
+	if path != m.FilePath {
+		return m.readPath(path)
+	}
+	data, err := m.fileStore().Read()
+	if err != nil {
+		return nil, err
+	}
+	if m.MaxConfigSize > 0 && int64(len(data)) > m.MaxConfigSize {
+		return nil, fmt.Errorf("Config file %s is larger than the maximum of %d bytes", path, m.MaxConfigSize)
+	}
+	return data, nil
+}
+
+// readPath reads the config file at the given path from disk, enforcing
+// MaxConfigSize.
+func (m *Manager) readPath(path string) ([]byte, error) {
+	if m.MaxConfigSize <= 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading config from %s: %s", path, err)
+		}
+		return data, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config from %s: %s", path, err)
+	}
+	defer file.Close()
+	// Read at most one byte more than allowed so that files growing after
+	// being stat'ed are caught too
+	data, err := ioutil.ReadAll(io.LimitReader(file, m.MaxConfigSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config from %s: %s", path, err)
+	}
+	if int64(len(data)) > m.MaxConfigSize {
+		return nil, fmt.Errorf("Config file %s is larger than the maximum of %d bytes", path, m.MaxConfigSize)
+	}
+	return data, nil
+}
+
+// recordLoaded remembers the stat and content hash of what was last loaded
+// from disk, so that unchanged files can be skipped on subsequent reloads.
+func (m *Manager) recordLoaded(fileInfo os.FileInfo, fileHash []byte) {
+	m.setFileInfo(fileInfo)
+	m.fileHash = fileHash
+}
+
+// setFileInfo records the stat of the config file as last loaded or saved.
+func (m *Manager) setFileInfo(fileInfo os.FileInfo) {
+	m.fileInfo = fileInfo
+	m.fileInfoAt = time.Now()
+	m.cfgMutex.Lock()
+	defer m.cfgMutex.Unlock()
+	m.lastModified = fileInfo.ModTime()
+}
+
 func (m *Manager) saveToDiskAndUpdate(updated Config) (bool, error) {
-	log.Trace("Applying defaults before saving")
-	updated.ApplyDefaults()
+	changed, err := m.prepareSave(updated)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	m.logger().Debug("Configuration changed programmatically, saving")
+	if err := m.save(updated); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// save writes the prepared config to disk, records it in the history and
+// makes it current.
+func (m *Manager) save(updated Config) error {
+	if err := m.writeToDisk(updated); err != nil {
+		return err
+	}
+
+	m.recordHistory(updated)
+
+	m.logger().Trace("Point to updated")
+	m.setCfg(updated)
+	return nil
+}
+
+// updateInMemory is like saveToDiskAndUpdate, except that it leaves saving the
+// updated config to a later call to flushUpdates (see MinUpdateInterval).
+func (m *Manager) updateInMemory(updated Config) (bool, error) {
+	changed, err := m.prepareSave(updated)
+	if err != nil || !changed {
+		return false, err
+	}
+	m.logger().Debug("Configuration changed programmatically, deferring save")
+	m.setCfg(updated)
+	return true, nil
+}
+
+// flushUpdates saves the current config, which was updated in memory only.
+func (m *Manager) flushUpdates() error {
+	m.logger().Debug("Saving deferred updates")
+	if err := m.writeToDisk(m.cfg); err != nil {
+		return err
+	}
+	m.recordHistory(m.cfg)
+	return nil
+}
+
+// prepareSave prepares the updated config for saving (see prepareUpdate),
+// returning whether it differs from the current config.
+func (m *Manager) prepareSave(updated Config) (bool, error) {
+	if updated == nil {
+		return false, errNilConfig
+	}
+	changed, err := m.checkUpdate(m.cfg, updated)
+	if err != nil || !changed {
+		return false, err
+	}
+	if err := m.beforeSave(updated); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// beforeSave calls BeforeSave, if set, unless nothing is saved anyway.
+func (m *Manager) beforeSave(updated Config) error {
+	if m.BeforeSave != nil && !m.ReadOnly {
+		if err := m.BeforeSave(updated); err != nil {
+			return fmt.Errorf("BeforeSave failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// checkUpdate prepares the updated config (see prepareUpdate) and makes sure
+// that it doesn't change ImmutableFields, returning whether it differs from
+// current.
+func (m *Manager) checkUpdate(current Config, updated Config) (bool, error) {
+	changed, err := m.prepareUpdate(current, updated)
+	if err != nil || !changed {
+		return false, err
+	}
+	if err := m.checkImmutable(current, updated); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// saveWithVersion saves the given config with the given version, regardless of
+// whether its contents changed. Like with other updates, defaults are applied
+// and the config is validated before saving.
+func (m *Manager) saveWithVersion(updated Config, version int) (bool, error) {
+	if m.cfg != nil && m.cfg.GetVersion() == version {
+		m.logger().Trace("Version unchanged, do nothing")
+		return false, nil
+	}
+	m.applyDefaults(updated)
+	if err := m.validate(updated); err != nil {
+		return false, fmt.Errorf("Invalid config: %s", err)
+	}
+	if err := m.checkImmutable(m.cfg, updated); err != nil {
+		return false, err
+	}
+	updated.SetVersion(version)
+	if err := m.beforeSave(updated); err != nil {
+		return false, err
+	}
+	m.logger().Debugf("Resetting version to %d, saving", version)
+	if err := m.save(updated); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// prepareUpdate applies defaults to and validates the updated config and
+// determines whether it differs from the current config (ignoring version,
+// unless UnmanagedVersion is set). If it does, updated's version is set to the
+// next version (again unless UnmanagedVersion is set).
+func (m *Manager) prepareUpdate(current Config, updated Config) (bool, error) {
+	m.logger().Trace("Applying defaults before saving")
+	m.applyDefaults(updated)
+
+	if err := m.validate(updated); err != nil {
+		return false, fmt.Errorf("Invalid config: %s", err)
+	}
 
-	log.Trace("Remembering current version")
-	original := m.cfg
+	if m.UnmanagedVersion {
+		m.logger().Trace("Compare config including version")
+		if m.equal(current, updated) {
+			m.logger().Trace("Configuration unchanged, do nothing")
+			return false, nil
+		}
+		return true, nil
+	}
+
+	m.logger().Trace("Remembering current version")
+	original := current
+	currentVersion := 0
 	nextVersion := 0
 	if original != nil {
-		log.Trace("Copying original config in preparation for comparison")
+		m.logger().Trace("Copying original config in preparation for comparison")
 		var err error
-		original, err = m.copy(m.cfg)
+		original, err = m.copy(current)
 		if err != nil {
 			return false, fmt.Errorf("Unable to copy original config for comparison")
 		}
-		log.Trace("Set version to 0 prior to comparison")
+		m.logger().Trace("Set version to 0 prior to comparison")
 		original.SetVersion(0)
-		log.Trace("Incrementing version")
-		nextVersion = m.cfg.GetVersion() + 1
+		m.logger().Trace("Incrementing version")
+		currentVersion = current.GetVersion()
+		nextVersion = currentVersion + 1
+		if currentVersion == math.MaxInt {
+			m.logger().Debugf("Version reached maximum, wrapping around to 1")
+			nextVersion = 1
+		}
 	}
 
-	log.Trace("Compare config without version")
+	m.logger().Trace("Compare config without version")
 	updated.SetVersion(0)
-	if reflect.DeepEqual(original, updated) {
-		log.Trace("Configuration unchanged, do nothing")
+	if m.equal(original, updated) {
+		m.logger().Trace("Configuration unchanged, do nothing")
+		updated.SetVersion(currentVersion)
 		return false, nil
 	}
 
-	log.Debug("Configuration changed programmatically, saving")
-	log.Trace("Increment version")
+	m.logger().Trace("Increment version")
 	updated.SetVersion(nextVersion)
+	return true, nil
+}
 
-	log.Trace("Save updated")
-	err := m.writeToDisk(updated)
-	if err != nil {
-		return false, err
+// rejectInvalid handles an invalid config on disk by keeping the current
+// (last good) config and, if RewriteOnInvalid is set, restoring it to disk. It
+// returns the given error.
+func (m *Manager) rejectInvalid(err error) error {
+	if m.RewriteOnInvalid && m.cfg != nil {
+		m.logger().Debugf("Restoring last good config to %s", m.FilePath)
+		if writeErr := m.writeToDisk(m.cfg); writeErr != nil {
+			m.logger().Errorf("Unable to restore last good config: %s", writeErr)
+		}
 	}
+	return err
+}
 
-	log.Trace("Point to updated")
-	m.setCfg(updated)
-	return true, nil
+// applyDefaults applies the config's defaults, including nested ones if
+// ApplyNestedDefaults is set.
+func (m *Manager) applyDefaults(cfg Config) {
+	cfg.ApplyDefaults()
+	if m.ApplyNestedDefaults {
+		ApplyNestedDefaults(cfg)
+	}
+}
+
+// afterLoad calls AfterLoad, if set, on a loaded config whose defaults have
+// been applied.
+func (m *Manager) afterLoad(cfg Config) error {
+	if m.AfterLoad == nil {
+		return nil
+	}
+	if err := m.AfterLoad(cfg); err != nil {
+		return fmt.Errorf("AfterLoad failed: %s", err)
+	}
+	return nil
+}
+
+// equal determines whether the given configs are the same for the purpose of
+// detecting changes, using Equal if set.
+func (m *Manager) equal(a Config, b Config) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if m.Equal != nil {
+		return m.Equal(a, b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// checkImmutable returns an error if updated changes any of ImmutableFields
+// that have already been set (i.e. aren't zero) in current.
+func (m *Manager) checkImmutable(current Config, updated Config) error {
+	if current == nil {
+		return nil
+	}
+	for _, path := range m.ImmutableFields {
+		established := valueAt(current, path)
+		if established == nil || reflect.ValueOf(established).IsZero() {
+			continue
+		}
+		if !reflect.DeepEqual(established, valueAt(updated, path)) {
+			return fmt.Errorf("Field %s is immutable and can't be changed once set", path)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) validate(cfg Config) error {
+	if m.Validate == nil {
+		return nil
+	}
+	return m.Validate(cfg)
 }
 
 func (m *Manager) writeToDisk(cfg Config) error {
-	bytes, err := yaml.Marshal(cfg)
+	if m.ReadOnly {
+		m.logger().Trace("Read only, not writing config to disk")
+		return nil
+	}
+	marshal := m.marshal
+	if m.ExternalVersion {
+		marshal = m.marshalWithoutVersion
+	}
+	cfg, err := m.withoutEnv(cfg)
 	if err != nil {
-		return fmt.Errorf("Unable to marshal config yaml: %s", err)
+		return fmt.Errorf("Unable to copy config: %s", err)
 	}
-	err = ioutil.WriteFile(m.FilePath, bytes, 0644)
+	bytes, err := m.marshalLayer(cfg, marshal)
 	if err != nil {
-		return fmt.Errorf("Unable to write config yaml to file %s: %s", m.FilePath, err)
+		return fmt.Errorf("Unable to marshal config: %s", err)
+	}
+	raw := bytes
+	bytes, err = m.encrypt(bytes)
+	if err != nil {
+		return err
+	}
+	store := m.fileStore()
+	if err := store.Write(bytes); err != nil {
+		return err
 	}
-	m.fileInfo, err = os.Stat(m.FilePath)
+	m.setRawBytes(raw)
+	// What's on disk no longer matches what was last loaded, so make sure
+	// that restoring the loaded contents isn't mistaken for no change
+	m.fileHash = nil
+	if m.ExternalVersion {
+		// Written after the config so that a failure in between leaves a
+		// version on disk that's stale rather than ahead of the config
+		if err := m.writeExternalVersion(cfg.GetVersion()); err != nil {
+			return err
+		}
+	}
+	fileInfo, err := store.Stat()
 	if err != nil {
 		return fmt.Errorf("Unable to stat file %s: %s", m.FilePath, err)
 	}
+	m.setFileInfo(fileInfo)
 	return nil
 }
 
-// HasChangedOnDisk checks whether Config has changed on disk
-func (m *Manager) hasChangedOnDisk() bool {
-	nextFileInfo, err := os.Stat(m.fileInfo.Name())
+// modTimeRacy checks whether the config file was last modified within
+// modTimeResolution of when it was last stat'ed. If so, it may have been
+// rewritten since without its modtime changing, so the stat can't be trusted
+// to tell whether it changed.
+func (m *Manager) modTimeRacy() bool {
+	return !m.fileInfo.ModTime().Before(m.fileInfoAt.Add(-modTimeResolution))
+}
+
+// hasChangedOnDisk checks whether Config has changed on disk since it was last
+// loaded or saved. It returns an error if the file couldn't be stat'ed.
+func (m *Manager) hasChangedOnDisk() (bool, error) {
+	nextFileInfo, err := m.fileStore().Stat()
 	if err != nil {
-		return false
+		return false, fmt.Errorf("Unable to stat config file %s: %s", m.FilePath, err)
+	}
+	if m.fileInfo == nil {
+		return true, nil
 	}
-	hasChanged := nextFileInfo.Size() != m.fileInfo.Size() || nextFileInfo.ModTime() != m.fileInfo.ModTime()
-	return hasChanged
+	hasChanged := nextFileInfo.Size() != m.fileInfo.Size() || !nextFileInfo.ModTime().Equal(m.fileInfo.ModTime())
+	return hasChanged, nil
 }
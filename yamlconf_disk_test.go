@@ -0,0 +1,1921 @@
+package yamlconf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/yaml"
+)
+
+func TestPartialWriteLeavesConfigIntact(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	original := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "original",
+			I: FIXED_I,
+		},
+	}
+	saveConfig(t, file, original)
+
+	// Simulate a crash partway through writing the temp file
+	tmpPath := file.Name() + ".tmp"
+	err = ioutil.WriteFile(tmpPath, []byte("version: 2\nn:\n  s: trunc"), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write partial temp file: %s", err)
+	}
+
+	assertSavedConfigEquals(t, file, original)
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	first, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.Equal(t, original, first, "Original config should survive partial write")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "updated"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	_, err = os.Stat(tmpPath)
+	assert.True(t, os.IsNotExist(err), "Temp file should have been renamed into place")
+}
+
+func TestFileMode(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		t.Fatalf("Unable to chmod config file: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		FileMode: 0600,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	info, err := os.Stat(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to stat config file: %s", err)
+	}
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Config file should have configured mode")
+}
+
+func TestVersionOnDisk(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	saveConfig(t, file, &TestCfg{
+		Version: 5,
+		N: &Nested{
+			I: FIXED_I,
+		},
+	})
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+
+	newer := &TestCfg{
+		Version: 7,
+		N: &Nested{
+			S: "newer",
+			I: FIXED_I,
+		},
+	}
+	saveConfig(t, file, newer)
+	changed, err := m.reloadFromDisk()
+	assert.NoError(t, err, "Newer config on disk should be accepted")
+	assert.True(t, changed, "Newer config on disk should change config")
+	assert.Equal(t, newer, m.getCfg(), "Newer config on disk should become current")
+	assertSavedConfigEquals(t, file, newer)
+
+	saveConfig(t, file, &TestCfg{
+		Version: 6,
+		N: &Nested{
+			S: "older",
+			I: FIXED_I,
+		},
+	})
+	changed, err = m.reloadFromDisk()
+	assert.Error(t, err, "Older config on disk should be rejected")
+	assert.False(t, changed, "Older config on disk should not change config")
+	assert.Equal(t, newer, m.getCfg(), "Current config should be retained")
+	assertSavedConfigEquals(t, file, newer)
+}
+
+func TestReadOnly(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	original := []byte("n:\n  s: read only\n")
+	if err := ioutil.WriteFile(file.Name(), original, 0444); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	if err := os.Chmod(file.Name(), 0444); err != nil {
+		t.Fatalf("Unable to chmod config: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: pollInterval,
+		ReadOnly:         true,
+	}
+	first, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	assert.Equal(t, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "read only",
+			I: FIXED_I,
+		},
+	}, first, "Defaults should be applied in memory")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "updated"
+		return nil
+	})
+	assert.Error(t, err, "Update should fail in read only mode")
+
+	bod, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	assert.Equal(t, string(original), string(bod), "Config on disk should be untouched")
+
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		t.Fatalf("Unable to chmod config: %s", err)
+	}
+	if err := ioutil.WriteFile(file.Name(), []byte("n:\n  s: edited\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	assert.Equal(t, &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "edited",
+			I: FIXED_I,
+		},
+	}, m.Next(), "Edits to read only file should be picked up")
+}
+
+func TestReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: 1 * time.Hour,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	changed, err := m.Reload()
+	assert.NoError(t, err)
+	assert.False(t, changed, "Reload without edit should not change config")
+
+	edited := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "edited",
+			I: FIXED_I,
+		},
+	}
+	saveConfig(t, file, edited)
+	changed, err = m.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed, "Reload after edit should change config")
+	assert.Equal(t, edited, m.Current(), "Edit should be visible immediately after Reload")
+}
+
+func TestFileWatcher(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: 1 * time.Hour,
+		UseFileWatcher:   true,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	updates, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	<-updates // current config
+
+	for _, s := range []string{"first", "second"} {
+		edited := &TestCfg{
+			Version: 1,
+			N: &Nested{
+				S: s,
+				I: FIXED_I,
+			},
+		}
+		// Save the way editors do, by renaming over the original
+		tmpPath := file.Name() + ".edit"
+		b, err := yaml.Marshal(edited)
+		if err != nil {
+			t.Fatalf("Unable to marshal config: %s", err)
+		}
+		if err := ioutil.WriteFile(tmpPath, b, 0644); err != nil {
+			t.Fatalf("Unable to write config: %s", err)
+		}
+		if err := os.Rename(tmpPath, file.Name()); err != nil {
+			t.Fatalf("Unable to rename config: %s", err)
+		}
+
+		select {
+		case updated := <-updates:
+			assert.Equal(t, edited, updated, "Watcher should pick up edit")
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Watcher didn't pick up %s edit", s)
+		}
+	}
+}
+
+func TestUnchangedFileNotRewritten(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	original := []byte(`# Hand-edited config
+n:
+  # The nested settings
+  i: 55   # matches the default
+  s: commented
+version: 3
+`)
+	if err := ioutil.WriteFile(file.Name(), original, 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	bod, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	assert.Equal(t, string(original), string(bod), "Config that already satisfies defaults should not be rewritten")
+}
+
+func TestErrors(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: pollInterval,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+
+	if err := ioutil.WriteFile(file.Name(), []byte("not: [valid"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	select {
+	case err := <-m.Errors():
+		assert.Contains(t, err.Error(), "Unable to reload config from disk")
+	case <-time.After(pollInterval * 10):
+		t.Fatal("No error reported for bad config on disk")
+	}
+
+	m.Stop()
+	for range m.Errors() {
+		// drain until closed
+	}
+}
+
+func TestRewriteOnInvalid(t *testing.T) {
+	for _, rewrite := range []bool{false, true} {
+		file, err := ioutil.TempFile("", "yamlconf_test_")
+		if err != nil {
+			t.Fatalf("Unable to create temp file: %s", err)
+		}
+		defer os.Remove(file.Name())
+
+		m := &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath:         file.Name(),
+			RewriteOnInvalid: rewrite,
+			Validate: func(cfg Config) error {
+				tc := cfg.(*TestCfg)
+				if tc.N != nil && tc.N.S == "invalid" {
+					return fmt.Errorf("Invalid S")
+				}
+				return nil
+			},
+		}
+		if err := m.loadFromDisk(); err != nil {
+			t.Fatalf("Unable to load config: %s", err)
+		}
+		good := &TestCfg{
+			Version: 1,
+			N: &Nested{
+				S: "good",
+				I: FIXED_I,
+			},
+		}
+		saveConfig(t, file, good)
+		if _, err := m.reloadFromDisk(); err != nil {
+			t.Fatalf("Unable to reload good config: %s", err)
+		}
+
+		for _, bad := range []string{"not: [valid", "version: 1\nn:\n  s: invalid\n"} {
+			if err := ioutil.WriteFile(file.Name(), []byte(bad), 0644); err != nil {
+				t.Fatalf("Unable to write config: %s", err)
+			}
+			_, err = m.reloadFromDisk()
+			assert.Error(t, err, "Bad config should be rejected")
+			assert.Equal(t, good, m.getCfg(), "Last good config should remain active")
+			if rewrite {
+				assertSavedConfigEquals(t, file, good)
+			} else {
+				bod, _ := ioutil.ReadFile(file.Name())
+				assert.Equal(t, bad, string(bod), "Bad config should be left on disk")
+			}
+		}
+	}
+}
+
+func TestFilePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.yaml")
+	override := filepath.Join(dir, "override.yaml")
+	write := func(path string, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %s", path, err)
+		}
+	}
+	write(base, "n:\n  s: base\n  i: 55\n")
+	write(override, "version: 1\nn:\n  s: override\n")
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePaths:        []string{base, override},
+		FilePollInterval: 1 * time.Hour,
+	}
+	first, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.Equal(t, override, m.FilePath, "FilePath should be last of FilePaths")
+	assert.Equal(t, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "override",
+			I: 55,
+		},
+	}, first, "Later files should override earlier ones")
+
+	write(base, "n:\n  s: base\n  i: 60\n")
+	changed, err := m.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed, "Change to base should be detected")
+	assert.Equal(t, 60, m.Current().(*TestCfg).N.I)
+
+	write(override, "version: 1\nn:\n  s: changed\n")
+	changed, err = m.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed, "Change to override should be detected")
+	assert.Equal(t, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "changed",
+			I: 60,
+		},
+	}, m.Current())
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "updated"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	bod, err := ioutil.ReadFile(base)
+	if err != nil {
+		t.Fatalf("Unable to read base: %s", err)
+	}
+	assert.Equal(t, "n:\n  s: base\n  i: 60\n", string(bod), "Base file should never be written")
+	ovb, err := ioutil.ReadFile(override)
+	if err != nil {
+		t.Fatalf("Unable to read override: %s", err)
+	}
+	assert.True(t, strings.Contains(string(ovb), "s: updated"), "Updated value should be written to override")
+	assert.False(t, strings.Contains(string(ovb), "i:"), "Values from base should not be written to override")
+
+	write(base, "n:\n  s: base\n  i: 70\n")
+	changed, err = m.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed, "Change to base should be detected after update")
+	assert.Equal(t, &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "updated",
+			I: 70,
+		},
+	}, m.Current(), "Base should not be shadowed by override after update")
+}
+
+func TestFileWatcherMoveAwayThenCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         path,
+		FilePollInterval: 1 * time.Hour,
+		UseFileWatcher:   true,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	updates, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	<-updates // current config
+
+	for _, s := range []string{"first", "second"} {
+		edited := &TestCfg{
+			Version: 1,
+			N: &Nested{
+				S: s,
+				I: FIXED_I,
+			},
+		}
+		// Save the way vim does, by moving the original out of the way and
+		// only then creating the new file
+		if err := os.Rename(path, path+"~"); err != nil {
+			t.Fatalf("Unable to move config away: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		b, err := yaml.Marshal(edited)
+		if err != nil {
+			t.Fatalf("Unable to marshal config: %s", err)
+		}
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatalf("Unable to write config: %s", err)
+		}
+
+		select {
+		case updated := <-updates:
+			assert.Equal(t, edited, updated, "Watcher should pick up edit")
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Watcher didn't pick up %s edit", s)
+		}
+	}
+	assert.NoError(t, m.LastError(), "Watching should have continued without errors")
+}
+
+func TestFilePathsWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.yaml")
+	override := filepath.Join(dir, "override.yaml")
+	if err := ioutil.WriteFile(base, []byte("n:\n  s: base\n  i: 55\n"), 0644); err != nil {
+		t.Fatalf("Unable to write base: %s", err)
+	}
+	if err := ioutil.WriteFile(override, []byte("version: 1\nn:\n  s: override\n"), 0644); err != nil {
+		t.Fatalf("Unable to write override: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePaths:        []string{base, override},
+		FilePollInterval: 1 * time.Hour,
+		UseFileWatcher:   true,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	updates, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	<-updates // current config
+
+	if err := ioutil.WriteFile(base, []byte("n:\n  s: base\n  i: 60\n"), 0644); err != nil {
+		t.Fatalf("Unable to write base: %s", err)
+	}
+	select {
+	case updated := <-updates:
+		assert.Equal(t, 60, updated.(*TestCfg).N.I, "Watcher should pick up edit to base")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watcher didn't pick up edit to base")
+	}
+}
+
+func TestContentHashChangeDetection(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	if err := ioutil.WriteFile(file.Name(), []byte("version: 1\nn:\n  s: aaa\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	loaded, err := os.Stat(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to stat config: %s", err)
+	}
+
+	// Same size, different content, written so quickly after loading that the
+	// modtime is unchanged
+	if err := ioutil.WriteFile(file.Name(), []byte("version: 1\nn:\n  s: bbb\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	if err := os.Chtimes(file.Name(), loaded.ModTime(), loaded.ModTime()); err != nil {
+		t.Fatalf("Unable to set modtime: %s", err)
+	}
+	changed, err := m.reloadFromDisk()
+	if assert.NoError(t, err) {
+		assert.True(t, changed, "Same size edit should be detected")
+		assert.Equal(t, "bbb", m.getCfg().(*TestCfg).N.S)
+	}
+
+	// Same content, different modtime
+	// Parsing the YAML on disk as JSON would fail, so this ensures that
+	// unchanged contents aren't reparsed
+	m.Format = FormatJSON
+	later := time.Now().Add(1 * time.Hour)
+	if err := os.Chtimes(file.Name(), later, later); err != nil {
+		t.Fatalf("Unable to set modtime: %s", err)
+	}
+	changed, err = m.reloadFromDisk()
+	if assert.NoError(t, err) {
+		assert.False(t, changed, "Touching file without changing content should not count as change")
+	}
+}
+
+func TestRestoringLoadedContentsAfterSave(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	loaded := []byte("version: 1\nn:\n  s: a\n  i: 55\n")
+	if err := ioutil.WriteFile(file.Name(), loaded, 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: time.Hour,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "b"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+
+	// An external tool restores what was originally loaded
+	if err := ioutil.WriteFile(file.Name(), loaded, 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	later := time.Now().Add(1 * time.Hour)
+	if err := os.Chtimes(file.Name(), later, later); err != nil {
+		t.Fatalf("Unable to set modtime: %s", err)
+	}
+	_, err = m.Reload()
+	assert.Error(t, err, "Restored contents should be detected as a stale version")
+	assert.Equal(t, "b", m.getCfg().(*TestCfg).N.S)
+	assertSavedConfigEquals(t, file, &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "b",
+			I: FIXED_I,
+		},
+	})
+}
+
+func TestHasChangedOnDiskInSubdirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	subdir := filepath.Join(dir, "nested")
+	if err := os.Mkdir(subdir, 0755); err != nil {
+		t.Fatalf("Unable to create subdirectory: %s", err)
+	}
+	path := filepath.Join(subdir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("version: 1\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: path,
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+
+	changed, err := m.hasChangedOnDisk()
+	if assert.NoError(t, err) {
+		assert.False(t, changed, "Freshly loaded file should not have changed")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("version: 2\nn:\n  s: changed\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	changed, err = m.hasChangedOnDisk()
+	if assert.NoError(t, err) {
+		assert.True(t, changed, "Modified file should have changed")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Unable to remove config: %s", err)
+	}
+	_, err = m.hasChangedOnDisk()
+	assert.Error(t, err, "Missing file should result in error")
+}
+
+func TestFragmentDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %s", name, err)
+		}
+	}
+	write("10-base.yaml", "n:\n  s: base\n  i: 55\n")
+	write("20-feature.yaml", "n:\n  s: feature\n")
+	write("notes.txt", "n:\n  s: ignored\n")
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FragmentDir:      dir,
+		FilePollInterval: 1 * time.Hour,
+	}
+	first, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.Equal(t, filepath.Join(dir, "local.yaml"), m.FilePath, "FilePath should be target fragment")
+	assert.Equal(t, &TestCfg{
+		N: &Nested{
+			S: "feature",
+			I: 55,
+		},
+	}, first, "Fragments should be merged in lexical order")
+
+	write("20-feature.yaml", "n:\n  s: changed\n")
+	changed, err := m.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed, "Change to fragment should be detected")
+	assert.Equal(t, "changed", m.Current().(*TestCfg).N.S)
+
+	write("30-extra.yaml", "n:\n  i: 60\n")
+	changed, err = m.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed, "Added fragment should be detected")
+	assert.Equal(t, 60, m.Current().(*TestCfg).N.I)
+
+	if err := os.Remove(filepath.Join(dir, "30-extra.yaml")); err != nil {
+		t.Fatalf("Unable to remove fragment: %s", err)
+	}
+	changed, err = m.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed, "Removed fragment should be detected")
+	assert.Equal(t, 55, m.Current().(*TestCfg).N.I)
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "updated"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	bod, err := ioutil.ReadFile(filepath.Join(dir, "20-feature.yaml"))
+	if err != nil {
+		t.Fatalf("Unable to read fragment: %s", err)
+	}
+	assert.Equal(t, "n:\n  s: changed\n", string(bod), "Other fragments should never be written")
+	assert.Equal(t, "updated", m.Current().(*TestCfg).N.S)
+}
+
+func TestSkipSaveOnInit(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	original := []byte("# Missing defaults\nversion: 3\nn:\n  s: incomplete\n")
+	if err := ioutil.WriteFile(file.Name(), original, 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:       file.Name(),
+		SkipSaveOnInit: true,
+	}
+	first, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	assert.Equal(t, &TestCfg{
+		Version: 3,
+		N: &Nested{
+			S: "incomplete",
+			I: FIXED_I,
+		},
+	}, first, "Defaults should be applied in memory")
+	bod, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	assert.Equal(t, string(original), string(bod), "File should not be rewritten")
+}
+
+func TestReloadDebounce(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: 1 * time.Hour,
+		UseFileWatcher:   true,
+		ReloadDebounce:   pollInterval,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	updates, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	<-updates // current config
+
+	var last *TestCfg
+	for _, s := range []string{"first", "second", "third"} {
+		last = &TestCfg{
+			Version: 1,
+			N: &Nested{
+				S: s,
+				I: FIXED_I,
+			},
+		}
+		saveConfig(t, file, last)
+	}
+
+	select {
+	case updated := <-updates:
+		assert.Equal(t, last, updated, "Only the final write should be published")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watcher didn't pick up writes")
+	}
+	select {
+	case updated := <-updates:
+		t.Fatalf("Rapid writes should result in a single update, also got %v", updated)
+	case <-time.After(pollInterval * 3):
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	deploy := func(name string, content string) string {
+		target := filepath.Join(dir, name, "config.yaml")
+		if err := os.Mkdir(filepath.Dir(target), 0755); err != nil {
+			t.Fatalf("Unable to create directory: %s", err)
+		}
+		if err := ioutil.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write config: %s", err)
+		}
+		// Swap the symlink atomically
+		tmpLink := filepath.Join(dir, "config.yaml.new")
+		if err := os.Symlink(target, tmpLink); err != nil {
+			t.Fatalf("Unable to create symlink: %s", err)
+		}
+		if err := os.Rename(tmpLink, filepath.Join(dir, "config.yaml")); err != nil {
+			t.Fatalf("Unable to swap symlink: %s", err)
+		}
+		return target
+	}
+	link := filepath.Join(dir, "config.yaml")
+	target := deploy("v1", "version: 1\nn:\n  s: v1\n  i: 55\n")
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         link,
+		FilePollInterval: 1 * time.Hour,
+		FollowSymlinks:   true,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "updated"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("Unable to stat symlink: %s", err)
+	}
+	assert.True(t, info.Mode()&os.ModeSymlink != 0, "Symlink should be preserved")
+	b, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Unable to read target: %s", err)
+	}
+	saved := &TestCfg{}
+	if err := yaml.Unmarshal(b, saved); err != nil {
+		t.Fatalf("Unable to unmarshal target: %s", err)
+	}
+	assert.Equal(t, "updated", saved.N.S, "Update should be written to symlink target")
+
+	deploy("v2", "version: 3\nn:\n  s: v2\n  i: 55\n")
+	changed, err := m.Reload()
+	if assert.NoError(t, err) {
+		assert.True(t, changed, "Swapped symlink should be detected")
+		assert.Equal(t, "v2", m.getCfg().(*TestCfg).N.S)
+	}
+}
+
+func TestTolerateInitialSaveFailure(t *testing.T) {
+	for _, tolerate := range []bool{false, true} {
+		file, err := ioutil.TempFile("", "yamlconf_test_")
+		if err != nil {
+			t.Fatalf("Unable to create temp file: %s", err)
+		}
+		defer os.Remove(file.Name())
+		if err := ioutil.WriteFile(file.Name(), []byte("version: 1\nn:\n  s: loaded\n"), 0644); err != nil {
+			t.Fatalf("Unable to write config: %s", err)
+		}
+		// Writing fails if the temp file can't be created
+		if err := os.Mkdir(file.Name()+".tmp", 0755); err != nil {
+			t.Fatalf("Unable to block temp file: %s", err)
+		}
+		defer os.Remove(file.Name() + ".tmp")
+
+		m := &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath:                   file.Name(),
+			TolerateInitialSaveFailure: tolerate,
+		}
+		first, err := m.Init()
+		if !tolerate {
+			assert.Error(t, err, "Failure to save should be fatal by default")
+			continue
+		}
+		if !assert.NoError(t, err, "Failure to save should be tolerated") {
+			continue
+		}
+		assert.Equal(t, &TestCfg{
+			Version: 1,
+			N: &Nested{
+				S: "loaded",
+				I: FIXED_I,
+			},
+		}, first, "Loaded config should be kept")
+		select {
+		case err := <-m.Errors():
+			assert.Contains(t, err.Error(), "Unable to perform initial update")
+		default:
+			t.Error("Failure to save should be reported")
+		}
+		m.Stop()
+	}
+}
+
+func TestBeforeSave(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		BeforeSave: func(cfg Config) error {
+			tc := cfg.(*TestCfg)
+			if tc.N.S == "forbidden" {
+				return fmt.Errorf("Forbidden")
+			}
+			tc.N.S += " (stamped)"
+			return nil
+		},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "saved"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	expected := &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "saved (stamped)",
+			I: FIXED_I,
+		},
+	}
+	assertSavedConfigEquals(t, file, expected)
+	assert.Equal(t, expected, m.getCfg(), "Stamped config should be current")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "forbidden"
+		return nil
+	})
+	assert.Error(t, err, "Error from BeforeSave should abort update")
+	assertSavedConfigEquals(t, file, expected)
+}
+
+func TestMaxConfigSize(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	// Anchors and aliases are expanded like any other YAML
+	anchored := "base: &base\n  s: anchored\n  i: 55\nn: *base\n"
+	if err := ioutil.WriteFile(file.Name(), []byte(anchored), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:      file.Name(),
+		MaxConfigSize: int64(len(anchored)),
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	assert.Equal(t, &Nested{S: "anchored", I: 55}, m.cfg.(*TestCfg).N, "Alias should be expanded")
+
+	if err := ioutil.WriteFile(file.Name(), []byte(anchored+"\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	_, err = m.reloadFromDisk()
+	assert.Error(t, err, "Oversize config should be rejected")
+	assert.Equal(t, "anchored", m.cfg.(*TestCfg).N.S, "Current config should be kept")
+
+	m = &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:      file.Name(),
+		MaxConfigSize: int64(len(anchored)),
+	}
+	_, err = m.Init()
+	assert.Error(t, err, "Init should fail with oversize config")
+}
+
+func TestMaxConfigSizeAliases(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	// Lots of anchors and aliases that don't expand beyond the file's size
+	var anchored bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&anchored, "base%d: &base%d\n  s: anchored%d\n  i: %d\n", i, i, i, i)
+		fmt.Fprintf(&anchored, "alias%d: *base%d\n", i, i)
+	}
+	anchored.WriteString("n: *base999\n")
+	if err := ioutil.WriteFile(file.Name(), anchored.Bytes(), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:      file.Name(),
+		MaxConfigSize: int64(anchored.Len()),
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load anchor heavy config: %s", err)
+	}
+	assert.Equal(t, &Nested{S: "anchored999", I: 999}, m.cfg.(*TestCfg).N, "Aliases should be expanded")
+
+	// A small file whose nested aliases expand to 100000 nodes
+	var nested bytes.Buffer
+	nested.WriteString("a: &a [x, x, x, x, x, x, x, x, x, x]\n")
+	for _, name := range []string{"b", "c", "d", "e"} {
+		previous := string(rune(name[0] - 1))
+		fmt.Fprintf(&nested, "%s: &%s [%s]\n", name, name, strings.TrimSuffix(strings.Repeat("*"+previous+", ", 10), ", "))
+	}
+	nested.WriteString("n:\n  s: nested\n")
+	if err := ioutil.WriteFile(file.Name(), nested.Bytes(), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	m.MaxConfigSize = int64(nested.Len())
+	_, err = m.reloadFromDisk()
+	if assert.Error(t, err, "Config expanding beyond MaxConfigSize should be rejected") {
+		assert.True(t, strings.Contains(err.Error(), "nodes"), "Error should mention expansion, got: %s", err)
+	}
+	assert.Equal(t, "anchored999", m.cfg.(*TestCfg).N.S, "Current config should be kept")
+
+	m.MaxConfigSize = 0
+	_, err = m.reloadFromDisk()
+	assert.NoError(t, err, "Expansion should only be limited with MaxConfigSize")
+}
+
+func TestStagingPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	stagingPath := filepath.Join(dir, "config.yaml.staged")
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:    path,
+		StagingPath: stagingPath,
+		// Simulate a config that doesn't survive being written out
+		Marshal: func(cfg Config) ([]byte, error) {
+			if cfg.(*TestCfg).N.S == "corrupt" {
+				return []byte("not: [valid"), nil
+			}
+			return yaml.Marshal(cfg)
+		},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "promoted"
+		return nil
+	})
+	if !assert.NoError(t, err, "Valid staged config should be promoted") {
+		return
+	}
+	expected := &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "promoted",
+			I: FIXED_I,
+		},
+	}
+	live, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open live config: %s", err)
+	}
+	defer live.Close()
+	assertSavedConfigEquals(t, live, expected)
+	_, err = os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(err), "Staged config should have been moved to live path")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "corrupt"
+		return nil
+	})
+	assert.Error(t, err, "Invalid staged config should not be promoted")
+	assertSavedConfigEquals(t, live, expected)
+	staged, err := ioutil.ReadFile(stagingPath)
+	if assert.NoError(t, err, "Staged config should be left for inspection") {
+		assert.Equal(t, "not: [valid", string(staged))
+	}
+	assert.Equal(t, expected, m.getCfg(), "Current config should be kept")
+}
+
+func TestLastError(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: pollInterval,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.NoError(t, m.LastError(), "Should start out healthy")
+
+	if err := ioutil.WriteFile(file.Name(), []byte("not: [valid"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	time.Sleep(pollInterval * 3)
+	assert.Error(t, m.LastError(), "Reload error should be remembered")
+
+	saveConfig(t, file, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "fixed",
+			I: FIXED_I,
+		},
+	})
+	time.Sleep(pollInterval * 3)
+	assert.NoError(t, m.LastError(), "Successful reload should clear error")
+}
+
+func TestTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tempDir := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tempDir, 0755); err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: path,
+		TempDir:  tempDir,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	check := func(s string, version int) {
+		err := m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = s
+			return nil
+		})
+		if !assert.NoError(t, err, "Update should succeed") {
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Unable to open config: %s", err)
+		}
+		defer file.Close()
+		assertSavedConfigEquals(t, file, &TestCfg{
+			Version: version,
+			N: &Nested{
+				S: s,
+				I: FIXED_I,
+			},
+		})
+		for _, leftover := range []string{filepath.Join(tempDir, "config.yaml.tmp"), path + ".tmp"} {
+			_, err = os.Stat(leftover)
+			assert.True(t, os.IsNotExist(err), "%s should not be left behind", leftover)
+		}
+	}
+	check("same filesystem", 2)
+
+	// Simulate TempDir being on a different filesystem
+	var crossed int
+	rename = func(from string, to string) error {
+		if filepath.Dir(from) != filepath.Dir(to) {
+			crossed++
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+		}
+		return os.Rename(from, to)
+	}
+	defer func() {
+		rename = os.Rename
+	}()
+	check("different filesystem", 3)
+	assert.Equal(t, 1, crossed, "Rename across filesystems should have been attempted")
+}
+
+func TestFsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	var synced []string
+	syncFile = func(file *os.File) error {
+		synced = append(synced, file.Name())
+		return file.Sync()
+	}
+	defer func() {
+		syncFile = func(file *os.File) error {
+			return file.Sync()
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: path,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.Empty(t, synced, "Nothing should be synced unless Fsync is set")
+
+	m.Fsync = true
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "durable"
+		return nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{path + ".tmp", dir}, synced, "File and directory should be synced")
+}
+
+func TestKeyOrderOnDisk(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	if err := ioutil.WriteFile(file.Name(), []byte("version: 1\nn:\n  s: ordered\n  i: 55\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	fingerprint := m.Fingerprint()
+
+	// Same content with keys in a different order and different formatting
+	reordered := "n: {i: 55, s: ordered}\nversion: 1\n"
+	if err := ioutil.WriteFile(file.Name(), []byte(reordered), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	changed, err := m.reloadFromDisk()
+	if assert.NoError(t, err) {
+		assert.False(t, changed, "Reordering keys on disk should not count as a change")
+	}
+	assert.Equal(t, fingerprint, m.Fingerprint(), "Fingerprint should not depend on formatting on disk")
+	bod, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	assert.Equal(t, reordered, string(bod), "Reordered file should be left alone")
+}
+
+func TestAfterLoad(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	dir := filepath.Dir(file.Name())
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		AfterLoad: func(cfg Config) error {
+			tc := cfg.(*TestCfg)
+			if tc.N == nil || tc.N.S == "" {
+				return nil
+			}
+			if strings.HasPrefix(tc.N.S, "..") {
+				return fmt.Errorf("Path %s is outside of config directory", tc.N.S)
+			}
+			if !filepath.IsAbs(tc.N.S) {
+				tc.N.S = filepath.Join(dir, tc.N.S)
+			}
+			return nil
+		},
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+
+	saveConfig(t, file, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "data/cache",
+			I: FIXED_I,
+		},
+	})
+	changed, err := m.reloadFromDisk()
+	if err != nil {
+		t.Fatalf("Unable to reload config: %s", err)
+	}
+	assert.True(t, changed)
+	expected := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: filepath.Join(dir, "data/cache"),
+			I: FIXED_I,
+		},
+	}
+	assert.Equal(t, expected, m.getCfg(), "Relative path should be resolved")
+
+	changed, err = m.reloadFromDisk()
+	if assert.NoError(t, err) {
+		assert.False(t, changed, "Reloading same file should not be a change")
+	}
+
+	if err := ioutil.WriteFile(file.Name(), []byte("version: 1\nn:\n  s: ../escape\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	_, err = m.reloadFromDisk()
+	if assert.Error(t, err, "Error from AfterLoad should reject config") {
+		assert.True(t, strings.Contains(err.Error(), "outside of config directory"))
+	}
+	assert.Equal(t, expected, m.getCfg(), "Current config should be kept")
+}
+
+func TestAfterLoadSeesDefaults(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".etag")
+
+	if err := ioutil.WriteFile(file.Name(), []byte("version: 1\nn:\n  s: disk\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	source := &memorySource{}
+	source.set("n:\n  s: remote\n")
+	var seen []string
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:                file.Name(),
+		RemoteSource:            source,
+		RequireInitialHttpFetch: true,
+		AfterLoad: func(cfg Config) error {
+			tc := cfg.(*TestCfg)
+			if tc.N == nil {
+				return fmt.Errorf("Defaults not applied")
+			}
+			seen = append(seen, fmt.Sprintf("%s:%d", tc.N.S, tc.N.I))
+			return nil
+		},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	expected := []string{fmt.Sprintf("disk:%d", FIXED_I), fmt.Sprintf("remote:%d", FIXED_I)}
+	assert.Equal(t, expected, seen, "AfterLoad should see defaults for configs from disk and remote source")
+}
+
+func TestImmutableFields(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:        file.Name(),
+		ImmutableFields: []string{"N.S"},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	setS := func(s string) error {
+		return m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = s
+			return nil
+		})
+	}
+	assert.NoError(t, setS("cluster-1"), "Setting unset immutable field should be allowed")
+	expected := &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "cluster-1",
+			I: FIXED_I,
+		},
+	}
+	assert.Equal(t, expected, m.getCfg())
+
+	err = setS("cluster-2")
+	if assert.Error(t, err, "Changing immutable field should be rejected") {
+		assert.True(t, strings.Contains(err.Error(), "N.S"), "Error should name field")
+	}
+	assert.Error(t, m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N = nil
+		return nil
+	}), "Clearing immutable field should be rejected")
+	assert.Equal(t, expected, m.getCfg(), "Current config should be kept")
+	assertSavedConfigEquals(t, file, expected)
+
+	assert.NoError(t, m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.I = 77
+		return nil
+	}), "Changing other fields should be allowed")
+	expected = &TestCfg{
+		Version: 3,
+		N: &Nested{
+			S: "cluster-1",
+			I: 77,
+		},
+	}
+	assert.Equal(t, expected, m.getCfg())
+
+	saveConfig(t, file, &TestCfg{
+		Version: 3,
+		N: &Nested{
+			S: "cluster-2",
+			I: 77,
+		},
+	})
+	_, err = m.Reload()
+	assert.Error(t, err, "Changing immutable field on disk should be rejected")
+	assert.Equal(t, expected, m.getCfg(), "Current config should be kept")
+}
+
+func TestParseErrorLocation(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	if err := ioutil.WriteFile(file.Name(), []byte("version: 1\nn:\n  s: [unclosed\n  i: 5\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	_, err = m.Reload()
+	if !assert.Error(t, err, "Malformed config should be rejected") {
+		return
+	}
+	assert.True(t, strings.Contains(err.Error(), "line 3"), "Error should include line: %s", err)
+	assert.True(t, strings.Contains(err.Error(), ">    3 |   s: [unclosed\n     4 |   i: 5"), "Error should include snippet: %s", err)
+	var parseErr *ParseError
+	if assert.True(t, errors.As(err, &parseErr), "Error should be a ParseError") {
+		assert.Equal(t, file.Name(), parseErr.Source)
+		assert.Equal(t, 3, parseErr.Line)
+		assert.True(t, strings.HasPrefix(parseErr.Err.Error(), "yaml: "), "Original error should be kept")
+	}
+
+	m.Format = FormatJSON
+	data := []byte("{\n  \"n\": {\n    \"s\": \"x\",,\n  }\n}\n")
+	parseErr = newParseError(file.Name(), data, m.unmarshal(data, &TestCfg{}))
+	assert.Equal(t, 3, parseErr.Line)
+	assert.Equal(t, 15, parseErr.Column)
+	assert.True(t, strings.Contains(parseErr.Error(), "at line 3, column 15"), "Error should include position: %s", parseErr)
+}
+
+// cachingCfg is a config carrying a matcher compiled from Pattern when it's
+// loaded, which never compares equal under reflect.DeepEqual.
+type cachingCfg struct {
+	Version int
+	Pattern string
+	matches func(s string) bool
+}
+
+func (c *cachingCfg) GetVersion() int {
+	return c.Version
+}
+
+func (c *cachingCfg) SetVersion(version int) {
+	c.Version = version
+}
+
+func (c *cachingCfg) ApplyDefaults() {
+}
+
+func TestEqual(t *testing.T) {
+	for _, customEqual := range []bool{false, true} {
+		file, err := ioutil.TempFile("", "yamlconf_test_")
+		if err != nil {
+			t.Fatalf("Unable to create temp file: %s", err)
+		}
+		defer os.Remove(file.Name())
+
+		m := &Manager{
+			EmptyConfig: func() Config {
+				return &cachingCfg{}
+			},
+			FilePath: file.Name(),
+			AfterLoad: func(cfg Config) error {
+				cc := cfg.(*cachingCfg)
+				pattern := cc.Pattern
+				cc.matches = func(s string) bool { return strings.Contains(s, pattern) }
+				return nil
+			},
+		}
+		if customEqual {
+			m.Equal = func(a, b Config) bool {
+				ac, bc := a.(*cachingCfg), b.(*cachingCfg)
+				return ac.Version == bc.Version && ac.Pattern == bc.Pattern
+			}
+		}
+		if err := ioutil.WriteFile(file.Name(), []byte("version: 1\npattern: abc\n"), 0644); err != nil {
+			t.Fatalf("Unable to write config: %s", err)
+		}
+		if err := m.loadFromDisk(); err != nil {
+			t.Fatalf("Unable to load config: %s", err)
+		}
+
+		// Same config, different bytes
+		if err := ioutil.WriteFile(file.Name(), []byte("# comment\nversion: 1\npattern: abc\n"), 0644); err != nil {
+			t.Fatalf("Unable to write config: %s", err)
+		}
+		changed, err := m.reloadFromDisk()
+		if assert.NoError(t, err) {
+			assert.Equal(t, !customEqual, changed, "Transient field should only count as change without Equal (custom: %v)", customEqual)
+		}
+
+		if err := ioutil.WriteFile(file.Name(), []byte("version: 1\npattern: xyz\n"), 0644); err != nil {
+			t.Fatalf("Unable to write config: %s", err)
+		}
+		changed, err = m.reloadFromDisk()
+		if assert.NoError(t, err) {
+			assert.True(t, changed, "Actual change should be detected (custom: %v)", customEqual)
+			assert.True(t, m.getCfg().(*cachingCfg).matches("wxyz"))
+		}
+	}
+}
+
+func TestMinUpdateInterval(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	var writes int32
+	rename = func(from string, to string) error {
+		if to == file.Name() {
+			atomic.AddInt32(&writes, 1)
+		}
+		return os.Rename(from, to)
+	}
+	defer func() {
+		rename = os.Rename
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:          file.Name(),
+		FilePollInterval:  time.Hour,
+		MinUpdateInterval: 200 * time.Millisecond,
+		Validate: func(cfg Config) error {
+			if tc := cfg.(*TestCfg); tc.N != nil && tc.N.I < 0 {
+				return fmt.Errorf("Negative I")
+			}
+			return nil
+		},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	initialWrites := atomic.LoadInt32(&writes)
+
+	setI := func(i int) error {
+		return m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.I = i
+			return nil
+		})
+	}
+	for i := 1; i <= 100; i++ {
+		if err := setI(i); err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+	}
+	assert.Error(t, setI(-1), "Invalid update should fail even when deferred")
+	assert.Equal(t, 100, m.getCfg().(*TestCfg).N.I, "Updates should be applied in memory right away")
+	assert.Equal(t, 101, m.getCfg().GetVersion())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&writes)-initialWrites, "Only the first update should be saved right away")
+
+	// The first update was published right away, the rest together
+	for published := 0; published != 100; {
+		select {
+		case cfg := <-m.nextCfgCh:
+			published = cfg.(*TestCfg).N.I
+			assert.True(t, published == 1 || published == 100, "Deferred updates should be published together, got %d", published)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Deferred updates should be published")
+		}
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&writes)-initialWrites, "Deferred updates should be saved together")
+	assertSavedConfigEquals(t, file, &TestCfg{
+		Version: 101,
+		N: &Nested{
+			I: 100,
+		},
+	})
+
+	if err := setI(200); err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	m.Stop()
+	expected := &TestCfg{
+		Version: 102,
+		N: &Nested{
+			I: 200,
+		},
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&writes)-initialWrites, "Pending update should be saved by the time Stop returns")
+	assertSavedConfigEquals(t, file, expected)
+}
+
+func TestStopSavesPendingUpdates(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:          file.Name(),
+		FilePollInterval:  time.Hour,
+		MinUpdateInterval: time.Hour,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	for _, s := range []string{"first", "second"} {
+		err := m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = s
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+	}
+	m.Stop()
+	assertSavedConfigEquals(t, file, &TestCfg{
+		Version: 3,
+		N: &Nested{
+			S: "second",
+			I: FIXED_I,
+		},
+	})
+}
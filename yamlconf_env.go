@@ -0,0 +1,148 @@
+package yamlconf
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// envOverride records a field that was overridden from the environment, so
+// that the override can be left out when saving (see withoutEnv).
+type envOverride struct {
+	index    []int
+	original interface{}
+	value    interface{}
+}
+
+// applyEnv overrides fields of the given config that are tagged with
+// `env:"NAME"` using the value of the environment variable EnvPrefix+NAME, if
+// set. Fields nested inside nil pointers are skipped.
+func (m *Manager) applyEnv(cfg Config) error {
+	if m.EnvPrefix == "" {
+		return nil
+	}
+	var overrides []envOverride
+	if err := applyEnv(m.logger(), reflect.ValueOf(cfg), m.EnvPrefix, nil, &overrides); err != nil {
+		return err
+	}
+	m.envOverrides = overrides
+	return nil
+}
+
+func applyEnv(logger golog.Logger, v reflect.Value, prefix string, index []int, overrides *[]envOverride) error {
+	v = indirect(v)
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			if err := applyEnv(logger, v.Field(i), prefix, fieldIndex, overrides); err != nil {
+				return err
+			}
+			continue
+		}
+		value, found := os.LookupEnv(prefix + name)
+		if !found {
+			continue
+		}
+		logger.Debugf("Overriding %s from environment variable %s%s", field.Name, prefix, name)
+		original := v.Field(i).Interface()
+		if err := setFromString(v.Field(i), value); err != nil {
+			return fmt.Errorf("Unable to apply environment variable %s%s: %s", prefix, name, err)
+		}
+		*overrides = append(*overrides, envOverride{fieldIndex, original, v.Field(i).Interface()})
+	}
+	return nil
+}
+
+// withoutEnv returns a copy of cfg in which fields that still hold the value
+// from the environment are reset to the value they were loaded with, so that
+// overrides aren't persisted. If nothing was overridden, cfg itself is
+// returned.
+func (m *Manager) withoutEnv(cfg Config) (Config, error) {
+	if len(m.envOverrides) == 0 {
+		return cfg, nil
+	}
+	copied, err := m.copy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, override := range m.envOverrides {
+		field, found := fieldByIndex(reflect.ValueOf(copied), override.index)
+		if found && reflect.DeepEqual(field.Interface(), override.value) {
+			field.Set(reflect.ValueOf(override.original))
+		}
+	}
+	return copied, nil
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but reports whether the
+// field was found rather than panicking on nil pointers.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for _, i := range index {
+		v = indirect(v)
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+		v = v.Field(i)
+	}
+	return v, true
+}
+
+// indirect dereferences pointers and interfaces, returning the zero Value if
+// it encounters a nil.
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func setFromString(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	default:
+		return fmt.Errorf("Unsupported field type %v", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+type EnvCfg struct {
+	Version int
+	Name    string        `env:"NAME"`
+	Port    int           `env:"PORT"`
+	Debug   bool          `env:"DEBUG"`
+	Timeout time.Duration `env:"TIMEOUT"`
+	Other   string
+	N       *EnvNested
+}
+
+type EnvNested struct {
+	S string `env:"NESTED_S"`
+}
+
+func (c *EnvCfg) GetVersion() int {
+	return c.Version
+}
+
+func (c *EnvCfg) SetVersion(version int) {
+	c.Version = version
+}
+
+func (c *EnvCfg) ApplyDefaults() {
+}
+
+func TestEnvOverrides(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	err = ioutil.WriteFile(file.Name(), []byte("name: file\nport: 80\nother: file\nn:\n  s: file\n"), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	for key, value := range map[string]string{
+		"YAMLCONF_TEST_NAME":     "env",
+		"YAMLCONF_TEST_PORT":     "8080",
+		"YAMLCONF_TEST_DEBUG":    "true",
+		"YAMLCONF_TEST_TIMEOUT":  "5s",
+		"YAMLCONF_TEST_NESTED_S": "nested env",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &EnvCfg{}
+		},
+		FilePath:  file.Name(),
+		EnvPrefix: "YAMLCONF_TEST_",
+	}
+	first, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	assert.Equal(t, &EnvCfg{
+		Name:    "env",
+		Port:    8080,
+		Debug:   true,
+		Timeout: 5 * time.Second,
+		Other:   "file",
+		N: &EnvNested{
+			S: "nested env",
+		},
+	}, first, "Environment should override file")
+}
+
+func TestEnvOverrideInvalid(t *testing.T) {
+	os.Setenv("YAMLCONF_TEST_PORT", "not a number")
+	defer os.Unsetenv("YAMLCONF_TEST_PORT")
+
+	m := &Manager{EnvPrefix: "YAMLCONF_TEST_"}
+	assert.Error(t, m.applyEnv(&EnvCfg{}), "Invalid value should fail")
+}
+
+func TestEnvOverridesNotSaved(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	err = ioutil.WriteFile(file.Name(), []byte("version: 1\nport: 80\nother: file\nn:\n  s: file\n"), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	os.Setenv("YAMLCONF_TEST_PORT", "8080")
+	defer os.Unsetenv("YAMLCONF_TEST_PORT")
+	os.Setenv("YAMLCONF_TEST_NESTED_S", "nested env")
+	defer os.Unsetenv("YAMLCONF_TEST_NESTED_S")
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &EnvCfg{}
+		},
+		FilePath:  file.Name(),
+		EnvPrefix: "YAMLCONF_TEST_",
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*EnvCfg).Other = "updated"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	assert.Equal(t, 8080, m.Current().(*EnvCfg).Port, "Override should still apply in memory")
+	saved, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	assert.True(t, strings.Contains(string(saved), "port: 80\n"), "Original value should be saved")
+	assert.True(t, strings.Contains(string(saved), "s: file\n"), "Original nested value should be saved")
+	assert.True(t, strings.Contains(string(saved), "other: updated\n"), "Update should be saved")
+	assert.False(t, strings.Contains(string(saved), "8080"), "Override should not be saved")
+	assert.False(t, strings.Contains(string(saved), "nested env"), "Nested override should not be saved")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*EnvCfg).Port = 9090
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	saved, err = ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	assert.True(t, strings.Contains(string(saved), "port: 9090\n"), "Explicit change to an overridden field should be saved")
+}
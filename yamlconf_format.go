@@ -0,0 +1,274 @@
+package yamlconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/yaml"
+)
+
+// Format identifies the serialization format of the config file.
+type Format int
+
+const (
+	// FormatAuto detects the format from the extension of FilePath (.json for
+	// JSON, anything else for YAML).
+	FormatAuto Format = iota
+
+	// FormatYAML serializes the config as YAML.
+	FormatYAML
+
+	// FormatJSON serializes the config as JSON.
+	FormatJSON
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatYAML:
+		return "yaml"
+	case FormatJSON:
+		return "json"
+	default:
+		return "auto"
+	}
+}
+
+// formatFor determines the format to use for the file at the given path.
+func formatFor(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	default:
+		return FormatYAML
+	}
+}
+
+func (m *Manager) marshal(cfg Config) ([]byte, error) {
+	if m.Marshal != nil {
+		return m.Marshal(cfg)
+	}
+	if m.Format == FormatJSON {
+		return json.MarshalIndent(cfg, "", "  ")
+	}
+	return yaml.Marshal(cfg)
+}
+
+func (m *Manager) unmarshal(bytes []byte, cfg Config) error {
+	if len(bytes) == 0 {
+		// Treat an empty file like an empty YAML document, whatever the format
+		return nil
+	}
+	if m.Unmarshal != nil {
+		return m.Unmarshal(bytes, cfg)
+	}
+	var err error
+	if m.Format == FormatJSON {
+		err = json.Unmarshal(bytes, cfg)
+	} else {
+		if m.MaxConfigSize > 0 {
+			if err := checkExpansion(bytes, m.MaxConfigSize); err != nil {
+				return err
+			}
+		}
+		err = yaml.Unmarshal(bytes, cfg)
+	}
+	if err != nil && m.Lenient {
+		return m.unmarshalFirstDocument(bytes, cfg, err)
+	}
+	return err
+}
+
+var errTooManyNodes = errors.New("too many nodes")
+
+var (
+	// nodeBudget is how many more nodes checkExpansion may decode. Since the
+	// yaml package creates nodeCounters itself, they can't carry the budget
+	// with them, so checks are serialized on nodeBudgetMutex instead.
+	nodeBudget      int64
+	nodeBudgetMutex sync.Mutex
+)
+
+// checkExpansion checks that data expands to at most maxNodes YAML nodes once
+// aliases have been expanded. A small document that aliases aliases can
+// otherwise expand exponentially while being decoded. Since every node takes
+// up at least a byte unless it's an alias, MaxConfigSize is used as the
+// limit. Errors other than exceeding the limit are left for the actual
+// unmarshaling to report.
+func checkExpansion(data []byte, maxNodes int64) error {
+	nodeBudgetMutex.Lock()
+	defer nodeBudgetMutex.Unlock()
+	nodeBudget = maxNodes
+	var root nodeCounter
+	if err := yaml.Unmarshal(data, &root); err == errTooManyNodes {
+		return fmt.Errorf("Config expands to more than %d nodes, likely due to nested aliases", maxNodes)
+	}
+	return nil
+}
+
+// nodeCounter counts the nodes it's unmarshaled from against nodeBudget,
+// failing with errTooManyNodes once the budget runs out.
+type nodeCounter struct{}
+
+func (nodeCounter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	nodeBudget--
+	if nodeBudget < 0 {
+		return errTooManyNodes
+	}
+	// Only the attempt matching the kind of node descends into it
+	var mapping map[interface{}]nodeCounter
+	if err := unmarshal(&mapping); err == nil || err == errTooManyNodes {
+		return err
+	}
+	var sequence []nodeCounter
+	if err := unmarshal(&sequence); err == nil || err == errTooManyNodes {
+		return err
+	}
+	return nil
+}
+
+// unmarshalFirstDocument unmarshals only the first document in data, ignoring
+// whatever follows it, after unmarshaling the whole of data failed with err.
+// If there's nothing following the first document, or the first document
+// itself can't be unmarshaled, err is returned.
+func (m *Manager) unmarshalFirstDocument(data []byte, cfg Config, err error) error {
+	if m.Format == FormatJSON {
+		// The decoder stops at the end of the first JSON value
+		if decodeErr := json.NewDecoder(bytes.NewReader(data)).Decode(cfg); decodeErr != nil {
+			return err
+		}
+		m.logger().Errorf("WARNING: Ignoring trailing content after config: %s", err)
+		return nil
+	}
+	first, found := firstDocument(data)
+	if !found {
+		return err
+	}
+	if yaml.Unmarshal(first, cfg) != nil {
+		return err
+	}
+	m.logger().Errorf("WARNING: Ignoring trailing content after first document in config: %s", err)
+	return nil
+}
+
+// firstDocument returns the first YAML document in data, up to the document
+// end marker (...) or separator (---) that ends it. It returns false if there's
+// no such marker.
+func firstDocument(data []byte) ([]byte, bool) {
+	offset := 0
+	started := false
+	for offset < len(data) {
+		end := offset
+		for end < len(data) && data[end] != '\n' {
+			end++
+		}
+		line := strings.TrimRight(string(data[offset:end]), " \t\r")
+		isMarker := line == "..." || line == "---" || strings.HasPrefix(line, "--- ")
+		if isMarker && started {
+			return data[:offset], true
+		}
+		if line != "" && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "%") {
+			// Content (including a leading ---) starts the first document
+			started = true
+		}
+		offset = end + 1
+	}
+	return nil, false
+}
+
+// ParseError is returned (possibly wrapped) when a config can't be unmarshaled.
+// Where the underlying error allows, it locates the problem within the config.
+type ParseError struct {
+	// Source is the file (or remote source) whose config couldn't be parsed.
+	Source string
+
+	// Line and Column locate the problem (counting from 1), or are 0 if
+	// unknown. YAML errors only identify the line.
+	Line   int
+	Column int
+
+	// Snippet shows the lines around Line, if known.
+	Snippet string
+
+	// Err is the error from unmarshaling.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("Error unmarshaling config from %s", e.Source)
+	if e.Line > 0 && !yamlErrorLine.MatchString(e.Err.Error()) {
+		// YAML errors already mention the line
+		msg += fmt.Sprintf(" at line %d", e.Line)
+		if e.Column > 0 {
+			msg += fmt.Sprintf(", column %d", e.Column)
+		}
+	}
+	msg += ": " + e.Err.Error()
+	if e.Snippet != "" {
+		msg += "\n" + e.Snippet
+	}
+	return msg
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+var yamlErrorLine = regexp.MustCompile(`\bline (\d+):`)
+
+// newParseError builds a ParseError for the error from unmarshaling data from
+// source.
+func newParseError(source string, data []byte, err error) *ParseError {
+	pe := &ParseError{Source: source, Err: err}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		pe.Line, pe.Column = position(data, syntaxErr.Offset)
+	} else if errors.As(err, &typeErr) {
+		pe.Line, pe.Column = position(data, typeErr.Offset)
+	} else if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+		pe.Line, _ = strconv.Atoi(match[1])
+	}
+	if pe.Line > 0 {
+		pe.Snippet = snippet(data, pe.Line)
+	}
+	return pe
+}
+
+// position converts an offset into data into a line and column.
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// snippet returns the given line of data along with the lines before and after
+// it, as the line reported by the YAML parser is sometimes off by one.
+func snippet(data []byte, line int) string {
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if line > len(lines) {
+		line = len(lines)
+	}
+	var b strings.Builder
+	for i := line - 1; i <= line+1; i++ {
+		if i < 1 || i > len(lines) {
+			continue
+		}
+		marker := " "
+		if i == line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "%s %4d | %s\n", marker, i, lines[i-1])
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,184 @@
+package yamlconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestFormatFor(t *testing.T) {
+	assert.Equal(t, FormatJSON, formatFor("config.json"))
+	assert.Equal(t, FormatJSON, formatFor("/etc/app/CONFIG.JSON"))
+	assert.Equal(t, FormatYAML, formatFor("config.yaml"))
+	assert.Equal(t, FormatYAML, formatFor("config.yml"))
+	assert.Equal(t, FormatYAML, formatFor("config"))
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatYAML, FormatJSON} {
+		m := &Manager{Format: format}
+		orig := &TestCfg{
+			Version: 3,
+			N: &Nested{
+				S: "round trip",
+				I: 7,
+			},
+		}
+		b, err := m.marshal(orig)
+		if !assert.NoError(t, err, "Unable to marshal %v", format) {
+			continue
+		}
+		roundTripped := &TestCfg{}
+		if assert.NoError(t, m.unmarshal(b, roundTripped), "Unable to unmarshal %v", format) {
+			assert.Equal(t, orig, roundTripped, "Config should survive %v round trip", format)
+		}
+	}
+}
+
+func TestJSONFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_*.json")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.Equal(t, FormatJSON, m.Format, "Format should be detected from extension")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "json"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+
+	expected, err := json.MarshalIndent(&TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "json",
+			I: FIXED_I,
+		},
+	}, "", "  ")
+	if err != nil {
+		t.Fatalf("Unable to marshal expected to json: %s", err)
+	}
+	bod, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config from disk: %s", err)
+	}
+	if !bytes.Equal(expected, bod) {
+		t.Errorf("Saved config doesn't equal expected.\n---- Expected ----\n%s\n\n---- On Disk ----:\n%s\n\n", string(expected), string(bod))
+	}
+}
+
+func TestCustomMarshaling(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	var marshaled, unmarshaled int
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		Marshal: func(cfg Config) ([]byte, error) {
+			marshaled++
+			return json.Marshal(cfg)
+		},
+		Unmarshal: func(bytes []byte, cfg Config) error {
+			unmarshaled++
+			return json.Unmarshal(bytes, cfg)
+		},
+		FilePollInterval: 1 * time.Hour,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "custom"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+
+	bod, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	saved := &TestCfg{}
+	if assert.NoError(t, json.Unmarshal(bod, saved), "Config should be saved with custom Marshal") {
+		assert.Equal(t, m.getCfg(), saved)
+	}
+	assert.True(t, marshaled > 0, "Custom Marshal should be used")
+
+	if err := ioutil.WriteFile(file.Name(), []byte(`{"Version": 2, "N": {"S": "edited", "I": 5}}`), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	changed, err := m.Reload()
+	if assert.NoError(t, err) {
+		assert.True(t, changed)
+		assert.Equal(t, "edited", m.getCfg().(*TestCfg).N.S, "Config should be loaded with custom Unmarshal")
+	}
+	assert.True(t, unmarshaled > 0, "Custom Unmarshal should be used")
+}
+
+func TestLenient(t *testing.T) {
+	good := &TestCfg{N: &Nested{S: "good", I: 5}}
+	for _, tc := range []struct {
+		format  Format
+		content string
+		ok      bool
+	}{
+		{FormatYAML, "n:\n  s: good\n  i: 5\n---\nn: [bad\n\x00", true},
+		{FormatYAML, "---\nn:\n  s: good\n  i: 5\n...\n\x00\x01garbage{{\n", true},
+		{FormatYAML, "# comment\nn:\n  s: good\n  i: 5\n--- \x00junk", true},
+		{FormatJSON, `{"n": {"s": "good", "i": 5}}}garbage`, true},
+		// Corruption of the first document isn't masked
+		{FormatYAML, "n:\n  s: good\n}}}garbage\n---\nn: {}\n", false},
+		{FormatYAML, "n:\n  s: good\n  i: 5\n}}}garbage\n", false},
+		{FormatJSON, `{"n": {"s": "good", "i": 5}`, false},
+	} {
+		strict := &Manager{Format: tc.format}
+		assert.Error(t, strict.unmarshal([]byte(tc.content), &TestCfg{}), "%q should fail without Lenient", tc.content)
+
+		m := &Manager{Format: tc.format, Lenient: true}
+		cfg := &TestCfg{}
+		err := m.unmarshal([]byte(tc.content), cfg)
+		if !tc.ok {
+			assert.Error(t, err, "%q should fail even with Lenient", tc.content)
+		} else if assert.NoError(t, err, "%q should succeed with Lenient", tc.content) {
+			assert.Equal(t, good, cfg, "%q should load first document", tc.content)
+		}
+	}
+}
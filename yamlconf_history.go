@@ -0,0 +1,132 @@
+package yamlconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyTimeFormat is the format of the time in the names of files in
+// HistoryDir. Parsing with it also accepts names without fractional seconds,
+// as recorded by earlier versions.
+const historyTimeFormat = "20060102T150405.000000000"
+
+// HistoryEntry describes a version of the config kept in HistoryDir.
+type HistoryEntry struct {
+	// Version is the config's version.
+	Version int
+
+	// Time is when the version was saved.
+	Time time.Time
+
+	// Path is the path of the file holding the version.
+	Path string
+}
+
+// History lists the versions of the config kept in HistoryDir, oldest first.
+// The files hold the config as saved (encrypted if Cipher is set), so unless
+// Cipher is set, they can be passed to Restore for rolling back.
+func (m *Manager) History() ([]HistoryEntry, error) {
+	if m.HistoryDir == "" {
+		return nil, fmt.Errorf("HistoryDir not specified")
+	}
+	infos, err := ioutil.ReadDir(m.HistoryDir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list history in %s: %s", m.HistoryDir, err)
+	}
+	prefix, ext := m.historyPrefix()
+	var entries []HistoryEntry
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		ts, err := time.Parse(historyTimeFormat, parts[1])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, HistoryEntry{
+			Version: version,
+			Time:    ts,
+			Path:    filepath.Join(m.HistoryDir, name),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.Before(entries[j].Time)
+		}
+		return entries[i].Version < entries[j].Version
+	})
+	return entries, nil
+}
+
+// PruneHistory removes all but the newest keep versions from HistoryDir. keep
+// must not be negative.
+func (m *Manager) PruneHistory(keep int) error {
+	if keep < 0 {
+		return fmt.Errorf("Number of versions to keep must not be negative, got %d", keep)
+	}
+	entries, err := m.History()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(entries)-keep; i++ {
+		if err := os.Remove(entries[i].Path); err != nil {
+			return fmt.Errorf("Unable to prune history: %s", err)
+		}
+	}
+	return nil
+}
+
+// historyPrefix returns the prefix and extension of the files in HistoryDir,
+// based on the name of FilePath (e.g. "config-v" and ".yaml").
+func (m *Manager) historyPrefix() (string, string) {
+	ext := filepath.Ext(m.FilePath)
+	return strings.TrimSuffix(filepath.Base(m.FilePath), ext) + "-v", ext
+}
+
+// recordHistory saves a copy of the given config to HistoryDir, if specified.
+// Failing to do so is logged but doesn't fail the save.
+func (m *Manager) recordHistory(cfg Config) {
+	if m.HistoryDir == "" || m.ReadOnly {
+		return
+	}
+	saved, err := m.withoutEnv(cfg)
+	var bytes []byte
+	if err == nil {
+		bytes, err = m.marshal(saved)
+	}
+	if err == nil {
+		bytes, err = m.encrypt(bytes)
+	}
+	if err != nil {
+		m.logger().Errorf("Unable to record config history: %s", err)
+		return
+	}
+	prefix, ext := m.historyPrefix()
+	// Make sure that every entry sorts after the previous one, even if the
+	// clock is coarse or goes backwards, since versions needn't increase
+	// (e.g. after ResetVersion)
+	now := time.Now().UTC()
+	if !now.After(m.lastHistoryTime) {
+		now = m.lastHistoryTime.Add(time.Nanosecond)
+	}
+	m.lastHistoryTime = now
+	name := fmt.Sprintf("%s%d-%s%s", prefix, cfg.GetVersion(), now.Format(historyTimeFormat), ext)
+	if err := ioutil.WriteFile(filepath.Join(m.HistoryDir, name), bytes, m.FileMode); err != nil {
+		m.logger().Errorf("Unable to record config history: %s", err)
+	}
+}
@@ -0,0 +1,144 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	historyDir := filepath.Join(dir, "history")
+	if err := os.Mkdir(historyDir, 0755); err != nil {
+		t.Fatalf("Unable to create history dir: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:   filepath.Join(dir, "config.yaml"),
+		HistoryDir: historyDir,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	for _, s := range []string{"a", "b", "c"} {
+		err := m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = s
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+	}
+	// Files that aren't part of the history are ignored
+	if err := ioutil.WriteFile(filepath.Join(historyDir, "notes.txt"), nil, 0644); err != nil {
+		t.Fatalf("Unable to write file: %s", err)
+	}
+
+	entries, err := m.History()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var versions []int
+	for _, entry := range entries {
+		versions = append(versions, entry.Version)
+		assert.False(t, entry.Time.IsZero(), "Entry should have time")
+	}
+	assert.Equal(t, []int{1, 2, 3, 4}, versions, "Every saved version should be kept")
+
+	snapshot, err := ioutil.ReadFile(entries[2].Path)
+	if err != nil {
+		t.Fatalf("Unable to read history: %s", err)
+	}
+	if assert.NoError(t, m.Restore(snapshot), "History should be restorable") {
+		assert.Equal(t, "b", m.getCfg().(*TestCfg).N.S)
+	}
+
+	assert.Error(t, m.PruneHistory(-1), "Negative keep should fail")
+	entries, err = m.History()
+	if assert.NoError(t, err) {
+		assert.Len(t, entries, 5, "Failed pruning should not remove anything")
+	}
+
+	if !assert.NoError(t, m.PruneHistory(2)) {
+		return
+	}
+	entries, err = m.History()
+	if assert.NoError(t, err) && assert.Len(t, entries, 2) {
+		assert.Equal(t, 4, entries[0].Version)
+		assert.Equal(t, 5, entries[1].Version, "Restored version should be kept too")
+	}
+	_, err = os.Stat(filepath.Join(historyDir, "notes.txt"))
+	assert.NoError(t, err, "Pruning should leave other files alone")
+}
+
+func TestHistorySameVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	historyDir := filepath.Join(dir, "history")
+	if err := os.Mkdir(historyDir, 0755); err != nil {
+		t.Fatalf("Unable to create history dir: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:   filepath.Join(dir, "config.yaml"),
+		HistoryDir: historyDir,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	update := func(s string) {
+		err := m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = s
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+	}
+	// Saves versions 1 and 2 twice in quick succession
+	update("a")
+	if err := m.ResetVersion(1); err != nil {
+		t.Fatalf("Unable to reset version: %s", err)
+	}
+	update("b")
+
+	entries, err := m.History()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var versions []int
+	for _, entry := range entries {
+		versions = append(versions, entry.Version)
+	}
+	assert.Equal(t, []int{1, 2, 1, 2}, versions, "Saves of the same version should neither collide nor be reordered")
+	if len(entries) == 4 {
+		latest, err := ioutil.ReadFile(entries[3].Path)
+		if err != nil {
+			t.Fatalf("Unable to read history: %s", err)
+		}
+		assert.True(t, strings.Contains(string(latest), "s: b"), "Latest entry should hold latest save")
+	}
+}
@@ -0,0 +1,231 @@
+package yamlconf
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// buildHttpClient builds the client used for fetching from HttpURL, pinned to
+// HttpCert if specified.
+func (m *Manager) buildHttpClient() (*http.Client, error) {
+	return m.newHttpClient(nil)
+}
+
+// buildProxiedHttpClient builds a client like buildHttpClient's that connects
+// via the proxy at HttpProxyAddr.
+func (m *Manager) buildProxiedHttpClient() (*http.Client, error) {
+	proxyAddr := m.HttpProxyAddr
+	if !strings.Contains(proxyAddr, "://") {
+		proxyAddr = "http://" + proxyAddr
+	}
+	proxyURL, err := url.Parse(proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse HttpProxyAddr %s: %s", m.HttpProxyAddr, err)
+	}
+	return m.newHttpClient(http.ProxyURL(proxyURL))
+}
+
+func (m *Manager) newHttpClient(proxy func(*http.Request) (*url.URL, error)) (*http.Client, error) {
+	client := &http.Client{
+		Timeout: m.HttpTimeout,
+	}
+	if m.HttpCert == "" && proxy == nil {
+		return client, nil
+	}
+	// Start from the default transport to keep its timeouts, connection
+	// pooling, HTTP/2 support and HTTP(S)_PROXY handling
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		transport.Proxy = proxy
+	}
+	if m.HttpCert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(m.HttpCert)) {
+			return nil, fmt.Errorf("Unable to parse HttpCert")
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs: pool,
+		}
+	}
+	client.Transport = transport
+	return client, nil
+}
+
+// doFetchWithRetries fetches from the given url, retrying connection errors
+// and 5xx responses up to HttpMaxRetries times with exponential backoff (capped
+// at HttpPollInterval).
+func (m *Manager) doFetchWithRetries(url string, etag string) (*http.Response, error) {
+	delay := m.HttpRetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := m.doFetch(url, etag)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if err == nil {
+			m.closeBody(resp)
+			err = fmt.Errorf("Unexpected response status from %s: %s", url, resp.Status)
+		}
+		if attempt >= m.HttpMaxRetries {
+			return nil, err
+		}
+		m.logger().Debugf("%s, retrying in %v", err, delay)
+		select {
+		case <-m.getClock().After(delay):
+		case <-m.stopCh:
+			return nil, err
+		}
+		delay *= 2
+		if delay > m.HttpPollInterval {
+			delay = m.HttpPollInterval
+		}
+	}
+}
+
+// doFetch fetches from the given url directly, falling back to fetching via
+// HttpProxyAddr (if specified) if the direct fetch fails.
+func (m *Manager) doFetch(url string, etag string) (*http.Response, error) {
+	resp, err := m.doFetchWith(m.httpClient, url, etag)
+	if m.proxiedHttpClient == nil {
+		return resp, err
+	}
+	if err == nil {
+		m.logger().Debugf("Fetched config from %s directly", url)
+		return resp, nil
+	}
+	m.logger().Debugf("%s, trying via proxy at %s", err, m.HttpProxyAddr)
+	resp, proxiedErr := m.doFetchWith(m.proxiedHttpClient, url, etag)
+	if proxiedErr != nil {
+		return nil, fmt.Errorf("%s (and via proxy at %s: %s)", err, m.HttpProxyAddr, proxiedErr)
+	}
+	m.logger().Debugf("Fetched config from %s via proxy at %s", url, m.HttpProxyAddr)
+	return resp, nil
+}
+
+func (m *Manager) doFetchWith(client *http.Client, url string, etag string) (*http.Response, error) {
+	m.logger().Debugf("Fetching config from %s", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to construct request for %s: %s", url, err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	// Setting this explicitly disables transparent decompression in
+	// net/http, so readBody takes care of it
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch config from %s: %s", url, err)
+	}
+	return resp, nil
+}
+
+// readBody reads the body of the given response, decompressing it if
+// necessary.
+func readBody(resp *http.Response) ([]byte, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return ioutil.ReadAll(resp.Body)
+	}
+	r, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress gzip body: %s", err)
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (m *Manager) closeBody(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		m.logger().Debugf("Unable to close response body: %v", err)
+	}
+}
+
+// httpSource is the default RemoteSource, which fetches the config from
+// HttpURL, or HttpFallbackURLs if that fails.
+type httpSource struct {
+	m *Manager
+
+	// fallbackURL and fallbackETag identify the config last fetched from one
+	// of HttpFallbackURLs, if any
+	fallbackURL  string
+	fallbackETag string
+}
+
+// Fetch implements RemoteSource. A 304 (Not Modified) response is treated as
+// unchanged. The given etag is HttpURL's; the etags of HttpFallbackURLs are
+// tracked separately. Once a fallback's config has been fetched, HttpURL's etag
+// is cleared, so that the config is fetched again in full from HttpURL once it
+// recovers rather than the fallback's config being kept. A fallback's etag is
+// only recorded once its config has been applied (see commitFallbackETag), so
+// that a rejected config is fetched again.
+func (s *httpSource) Fetch(etag string) ([]byte, string, bool, error) {
+	m := s.m
+	s.fallbackURL, s.fallbackETag = "", ""
+	bytes, newETag, changed, err := s.fetchFrom(m.HttpURL, etag)
+	if err == nil {
+		return bytes, newETag, changed, nil
+	}
+	errs := []string{err.Error()}
+	for _, url := range m.HttpFallbackURLs {
+		m.logger().Debugf("%s, trying fallback %s", errs[len(errs)-1], url)
+		bytes, fallbackETag, changed, err := s.fetchFrom(url, m.fallbackETags[url])
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		s.fallbackURL, s.fallbackETag = url, fallbackETag
+		if changed {
+			etag = ""
+		}
+		return bytes, etag, changed, nil
+	}
+	return nil, "", false, fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// commitFallbackETag records the etag of the config fetched from one of
+// HttpFallbackURLs, if any, once that config has been applied.
+func (m *Manager) commitFallbackETag(fetched *remoteFetch) {
+	if fetched.fallbackURL == "" {
+		return
+	}
+	if m.fallbackETags == nil {
+		m.fallbackETags = make(map[string]string)
+	}
+	m.fallbackETags[fetched.fallbackURL] = fetched.fallbackETag
+}
+
+// fetchFrom fetches the config from the given url.
+func (s *httpSource) fetchFrom(url string, etag string) ([]byte, string, bool, error) {
+	m := s.m
+	resp, err := m.doFetchWithRetries(url, etag)
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer m.closeBody(resp)
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", false, fmt.Errorf("Unexpected response status from %s: %s", url, resp.Status)
+	}
+
+	bytes, err := readBody(resp)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("Error reading config from %s: %s", url, err)
+	}
+	if m.HttpVerify != nil {
+		if err := m.HttpVerify(bytes, resp.Header); err != nil {
+			return nil, "", false, fmt.Errorf("Unable to verify config from %s: %s", url, err)
+		}
+	}
+	m.logger().Debugf("Fetched config from %s", url)
+	return bytes, resp.Header.Get("ETag"), true, nil
+}
@@ -0,0 +1,1029 @@
+package yamlconf
+
+import (
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestHttpFetch(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	defer os.Remove(file.Name() + ".etag")
+
+	var notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == "abc" {
+			atomic.AddInt32(&notModified, 1)
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("ETag", "abc")
+		resp.Write([]byte("n:\n  s: remote\n"))
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		HttpURL:          srv.URL,
+		HttpPollInterval: 50 * time.Millisecond,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+
+	updated := m.Next()
+	assert.Equal(t, &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "remote",
+			I: FIXED_I,
+		},
+	}, updated, "Config fetched via http should contain correct data")
+	assertSavedConfigEquals(t, file, updated.(*TestCfg))
+	assert.Equal(t, "http", m.LastLoadedFrom(), "Config should come from http")
+
+	time.Sleep(pollInterval * 2)
+	assert.True(t, atomic.LoadInt32(&notModified) > 0, "Subsequent polls should send ETag and get 304")
+}
+
+func TestHttpPollWhileFilePolling(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		resp.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: 5 * time.Millisecond,
+		HttpURL:          srv.URL,
+		HttpPollInterval: 100 * time.Millisecond,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	// Expect an initial fetch plus one fetch per HttpPollInterval
+	time.Sleep(550 * time.Millisecond)
+	n := atomic.LoadInt32(&fetches)
+	assert.True(t, n >= 4 && n <= 8, "Expected roughly 6 http polls, got %d", n)
+}
+
+func TestHttpRetries(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		resp.Write([]byte("n:\n  s: retried\n"))
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:           file.Name(),
+		HttpURL:            srv.URL,
+		HttpPollInterval:   1 * time.Hour,
+		HttpMaxRetries:     3,
+		HttpRetryBaseDelay: 10 * time.Millisecond,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	assert.Equal(t, "retried", m.Next().(*TestCfg).N.S, "Config should be fetched after retries")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "Should have retried twice")
+}
+
+func TestHttpRetriesDontBlockUpdates(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:           file.Name(),
+		HttpURL:            srv.URL,
+		HttpPollInterval:   1 * time.Hour,
+		HttpMaxRetries:     3,
+		HttpRetryBaseDelay: 1 * time.Hour,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The fetch is now waiting to retry
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = "updated"
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Update should not wait for fetch to be retried")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop should not wait for fetch to be retried")
+	}
+}
+
+func TestHttpTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		HttpURL:     srv.URL,
+		HttpTimeout: 50 * time.Millisecond,
+	}
+	var err error
+	m.httpClient, err = m.buildHttpClient()
+	if err != nil {
+		t.Fatalf("Unable to build http client: %s", err)
+	}
+
+	start := time.Now()
+	_, err = m.fetchRemoteConfig()
+	assert.Error(t, err, "Fetch from hung server should time out")
+	assert.True(t, time.Now().Sub(start) < 1*time.Second, "Fetch should return promptly")
+}
+
+func TestHttpGzip(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	corrupt := false
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept-Encoding") != "gzip" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp.Header().Set("Content-Encoding", "gzip")
+		if corrupt {
+			resp.Write([]byte("not gzip"))
+			return
+		}
+		w := gzip.NewWriter(resp)
+		w.Write([]byte("n:\n  s: gzipped\n"))
+		w.Close()
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		HttpURL:  srv.URL,
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	m.httpClient, err = m.buildHttpClient()
+	if err != nil {
+		t.Fatalf("Unable to build http client: %s", err)
+	}
+
+	changed, err := m.fetchRemoteConfig()
+	assert.NoError(t, err, "Gzipped config should be fetched")
+	assert.True(t, changed, "Gzipped config should change config")
+	assert.Equal(t, "gzipped", m.getCfg().(*TestCfg).N.S, "Gzipped config should be decoded")
+
+	corrupt = true
+	changed, err = m.fetchRemoteConfig()
+	assert.Error(t, err, "Corrupt gzip should fail")
+	assert.False(t, changed, "Corrupt gzip should not change config")
+	assert.Equal(t, "gzipped", m.getCfg().(*TestCfg).N.S, "Current config should be kept")
+}
+
+func TestHttpVerify(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	body := []byte("n:\n  s: verified\n")
+	sum := sha256.Sum256(body)
+	tampered := false
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("X-Checksum", hex.EncodeToString(sum[:]))
+		if tampered {
+			resp.Write([]byte("n:\n  s: tampered\n"))
+			return
+		}
+		resp.Write(body)
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		HttpURL:  srv.URL,
+		HttpVerify: func(body []byte, headers http.Header) error {
+			sum := sha256.Sum256(body)
+			if hex.EncodeToString(sum[:]) != headers.Get("X-Checksum") {
+				return fmt.Errorf("Checksum mismatch")
+			}
+			return nil
+		},
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	m.httpClient, err = m.buildHttpClient()
+	if err != nil {
+		t.Fatalf("Unable to build http client: %s", err)
+	}
+
+	changed, err := m.fetchRemoteConfig()
+	assert.NoError(t, err, "Verified config should be fetched")
+	assert.True(t, changed, "Verified config should change config")
+
+	tampered = true
+	changed, err = m.fetchRemoteConfig()
+	assert.Error(t, err, "Tampered config should be rejected")
+	assert.False(t, changed, "Tampered config should not change config")
+	assert.Equal(t, "verified", m.getCfg().(*TestCfg).N.S, "Current config should be kept")
+}
+
+func TestHttpFetchBadStatus(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte("n:\n  s: broken\n"))
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		HttpURL:          srv.URL,
+		HttpPollInterval: 50 * time.Millisecond,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+
+	// Wait for a few polls
+	time.Sleep(pollInterval * 2)
+	assertSavedConfigEquals(t, file, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			I: FIXED_I,
+		},
+	})
+}
+
+func TestHttpCert(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("n:\n  s: pinned\n"))
+	}))
+	defer srv.Close()
+
+	newManager := func(cert string) *Manager {
+		return &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath: file.Name(),
+			HttpURL:  srv.URL,
+			HttpCert: cert,
+		}
+	}
+
+	m := newManager(generateCertPEM(t))
+	if _, err := m.Init(); err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	m.Stop()
+	_, err = m.fetchRemoteConfig()
+	assert.Error(t, err, "Fetch from server with mismatched cert should fail")
+
+	m = newManager(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+	if _, err := m.Init(); err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.Equal(t, "pinned", m.Next().(*TestCfg).N.S, "Fetch from server with pinned cert should succeed")
+	transport := m.httpClient.Transport.(*http.Transport)
+	defaults := http.DefaultTransport.(*http.Transport)
+	assert.NotNil(t, transport.Proxy, "Pinned client should honor proxy settings from the environment")
+	assert.Equal(t, defaults.TLSHandshakeTimeout, transport.TLSHandshakeTimeout, "Pinned client should keep default timeouts")
+	assert.Equal(t, defaults.MaxIdleConns, transport.MaxIdleConns, "Pinned client should keep default connection limits")
+	assert.True(t, transport.ForceAttemptHTTP2, "Pinned client should support HTTP/2")
+
+	_, err = newManager("not a cert").Init()
+	assert.Error(t, err, "Invalid HttpCert should fail Init")
+}
+
+func generateCertPEM(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestHttpETagPersisted(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	defer os.Remove(file.Name() + ".etag")
+
+	etagsCh := make(chan string, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		etag := req.Header.Get("If-None-Match")
+		etagsCh <- etag
+		if etag == "abc" {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("ETag", "abc")
+		resp.Write([]byte("n:\n  s: remote\n"))
+	}))
+	defer srv.Close()
+
+	newManager := func() *Manager {
+		return &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath: file.Name(),
+			HttpURL:  srv.URL,
+		}
+	}
+
+	m := newManager()
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	m.Next()
+	m.Stop()
+	assert.Equal(t, "", <-etagsCh, "First run should do a full fetch")
+
+	m = newManager()
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	assert.Equal(t, "abc", <-etagsCh, "Second run should send persisted etag")
+	m.Stop()
+
+	if err := ioutil.WriteFile(file.Name()+".etag", []byte("\x00\xffcorrupt"), 0644); err != nil {
+		t.Fatalf("Unable to write etag: %s", err)
+	}
+	m = newManager()
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	assert.Equal(t, "", <-etagsCh, "Corrupt etag should result in full fetch")
+	m.Stop()
+
+	// The persisted etag doesn't describe a newly created config
+	if err := os.Remove(file.Name()); err != nil {
+		t.Fatalf("Unable to remove file: %s", err)
+	}
+	if err := ioutil.WriteFile(file.Name()+".etag", []byte("abc\n"), 0644); err != nil {
+		t.Fatalf("Unable to write etag: %s", err)
+	}
+	m = newManager()
+	m.RequireInitialHttpFetch = true
+	cfg, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	assert.Equal(t, "", <-etagsCh, "Created config should result in full fetch")
+	assert.Equal(t, "remote", cfg.(*TestCfg).N.S)
+	m.Stop()
+}
+
+func TestHttpProxyFallback(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	// Simulate a blocked direct path using an address on which nothing is
+	// listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	blockedAddr := l.Addr().String()
+	l.Close()
+
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		if req.URL.Host != blockedAddr {
+			resp.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		resp.Write([]byte("n:\n  s: proxied\n"))
+	}))
+	defer proxy.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:      file.Name(),
+		HttpURL:       "http://" + blockedAddr + "/config",
+		HttpProxyAddr: proxy.Listener.Addr().String(),
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	m.httpClient, err = m.buildHttpClient()
+	if err != nil {
+		t.Fatalf("Unable to build http client: %s", err)
+	}
+	m.proxiedHttpClient, err = m.buildProxiedHttpClient()
+	if err != nil {
+		t.Fatalf("Unable to build proxied http client: %s", err)
+	}
+
+	changed, err := m.fetchRemoteConfig()
+	if assert.NoError(t, err, "Fetch should succeed via proxy") {
+		assert.True(t, changed)
+		assert.Equal(t, "proxied", m.getCfg().(*TestCfg).N.S, "Config should come via proxy")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxied))
+
+	direct := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("n:\n  s: direct\n"))
+	}))
+	defer direct.Close()
+	m.HttpURL = direct.URL
+	changed, err = m.fetchRemoteConfig()
+	if assert.NoError(t, err, "Direct fetch should succeed") {
+		assert.True(t, changed)
+		assert.Equal(t, "direct", m.getCfg().(*TestCfg).N.S, "Config should come directly")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxied), "Proxy should not be used when direct path works")
+}
+
+func TestNextHttpPoll(t *testing.T) {
+	m := &Manager{
+		HttpPollInterval: 1 * time.Minute,
+	}
+	assert.Equal(t, 1*time.Minute, m.nextHttpPoll(), "Interval should not be randomized by default")
+
+	m.RandomizeHttpPollInterval = true
+	for _, jitter := range []float64{0, 0.1, 1} {
+		m.HttpPollJitter = jitter
+		expected := jitter
+		if expected == 0 {
+			expected = 0.5
+		}
+		min := time.Duration(float64(m.HttpPollInterval) * (1 - expected))
+		max := time.Duration(float64(m.HttpPollInterval) * (1 + expected))
+		varied := false
+		for i := 0; i < 1000; i++ {
+			next := m.nextHttpPoll()
+			if next < min || next > max {
+				t.Fatalf("Interval %v with jitter %v outside of [%v, %v]", next, jitter, min, max)
+			}
+			if next != m.HttpPollInterval {
+				varied = true
+			}
+		}
+		assert.True(t, varied, "Interval should be randomized with jitter %v", jitter)
+	}
+}
+
+func TestHttpFallbackURLs(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	defer os.Remove(file.Name() + ".etag")
+
+	var primaryFailing int32
+	var primaryETags []string
+	primary := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&primaryFailing) == 1 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		primaryETags = append(primaryETags, req.Header.Get("If-None-Match"))
+		if req.Header.Get("If-None-Match") == "primary" {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("ETag", "primary")
+		resp.Write([]byte("n:\n  s: primary\n"))
+	}))
+	defer primary.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	down := "http://" + l.Addr().String() + "/config"
+	l.Close()
+
+	var fallbackNotModified int32
+	fallback := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == "fallback" {
+			atomic.AddInt32(&fallbackNotModified, 1)
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("ETag", "fallback")
+		resp.Write([]byte("n:\n  s: fallback\n"))
+	}))
+	defer fallback.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		HttpURL:          primary.URL,
+		HttpFallbackURLs: []string{down, fallback.URL},
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	m.httpClient, err = m.buildHttpClient()
+	if err != nil {
+		t.Fatalf("Unable to build http client: %s", err)
+	}
+
+	changed, err := m.fetchRemoteConfig()
+	if assert.NoError(t, err) && assert.True(t, changed) {
+		assert.Equal(t, "primary", m.getCfg().(*TestCfg).N.S, "Config should come from primary")
+	}
+
+	atomic.StoreInt32(&primaryFailing, 1)
+	changed, err = m.fetchRemoteConfig()
+	if assert.NoError(t, err, "Fetch should succeed via fallback") && assert.True(t, changed) {
+		assert.Equal(t, "fallback", m.getCfg().(*TestCfg).N.S, "Config should come from fallback")
+	}
+	assert.Equal(t, "", m.etag, "Fallback's config should clear primary's etag")
+
+	changed, err = m.fetchRemoteConfig()
+	if assert.NoError(t, err) {
+		assert.False(t, changed, "Unchanged fallback should report unchanged")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fallbackNotModified), "Fallback's own etag should be sent to it")
+
+	atomic.StoreInt32(&primaryFailing, 0)
+	changed, err = m.fetchRemoteConfig()
+	if assert.NoError(t, err) && assert.True(t, changed) {
+		assert.Equal(t, "primary", m.getCfg().(*TestCfg).N.S, "Config should come from primary after recovering")
+	}
+	assert.Equal(t, []string{"", ""}, primaryETags, "Primary should be fetched in full after recovering")
+	_, err = m.fetchRemoteConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "", "primary"}, primaryETags, "Primary should get its own etag again")
+
+	fallback.Close()
+	atomic.StoreInt32(&primaryFailing, 1)
+	_, err = m.fetchRemoteConfig()
+	assert.Error(t, err, "Fetch should fail if all URLs fail")
+}
+
+func TestHttpFallbackRejectedConfigRetried(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer os.Remove(file.Name() + ".etag")
+
+	primary := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+
+	var fallbackFetched int32
+	fallback := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == "fallback" {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&fallbackFetched, 1)
+		resp.Header().Set("ETag", "fallback")
+		resp.Write([]byte("n:\n  s: fallback\n"))
+	}))
+	defer fallback.Close()
+
+	var rejecting int32
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		HttpURL:          primary.URL,
+		HttpFallbackURLs: []string{fallback.URL},
+		Validate: func(cfg Config) error {
+			if atomic.LoadInt32(&rejecting) == 1 {
+				return fmt.Errorf("rejected")
+			}
+			return nil
+		},
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	m.httpClient, err = m.buildHttpClient()
+	if err != nil {
+		t.Fatalf("Unable to build http client: %s", err)
+	}
+
+	atomic.StoreInt32(&rejecting, 1)
+	_, err = m.fetchRemoteConfig()
+	assert.Error(t, err, "Fallback's config should be rejected")
+
+	atomic.StoreInt32(&rejecting, 0)
+	changed, err := m.fetchRemoteConfig()
+	if assert.NoError(t, err) && assert.True(t, changed, "Rejected config should be fetched again") {
+		assert.Equal(t, "fallback", m.getCfg().(*TestCfg).N.S)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fallbackFetched), "Fallback should be fetched in full again after rejection")
+
+	changed, err = m.fetchRemoteConfig()
+	if assert.NoError(t, err) {
+		assert.False(t, changed, "Applied config should not be fetched again")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fallbackFetched), "Fallback's etag should be sent once its config was applied")
+}
+
+func TestHttpTransform(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	defer os.Remove(file.Name() + ".etag")
+
+	var body atomic.Value
+	body.Store(`{"config": {"n": {"s": "unwrapped"}}}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(body.Load().(string)))
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		HttpURL:  srv.URL,
+		HttpTransform: func(body []byte) ([]byte, error) {
+			var envelope struct {
+				Config json.RawMessage `json:"config"`
+			}
+			if err := json.Unmarshal(body, &envelope); err != nil {
+				return nil, err
+			}
+			if envelope.Config == nil {
+				return nil, fmt.Errorf("Missing config in envelope")
+			}
+			return envelope.Config, nil
+		},
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	m.httpClient, err = m.buildHttpClient()
+	if err != nil {
+		t.Fatalf("Unable to build http client: %s", err)
+	}
+
+	changed, err := m.fetchRemoteConfig()
+	if assert.NoError(t, err) && assert.True(t, changed) {
+		assert.Equal(t, "unwrapped", m.getCfg().(*TestCfg).N.S, "Config should be unwrapped from envelope")
+	}
+
+	body.Store(`{"n": {"s": "no envelope"}}`)
+	_, err = m.fetchRemoteConfig()
+	assert.Error(t, err, "Error from transform should abort update")
+	assert.Equal(t, "unwrapped", m.getCfg().(*TestCfg).N.S, "Current config should be kept")
+}
+
+func TestNoHttpWithoutHttpURL(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	for _, remote := range []RemoteSource{nil, &memorySource{}} {
+		m := &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath: file.Name(),
+			// Would fail to parse if HTTP were set up
+			HttpCert:      "not a certificate",
+			HttpProxyAddr: "%%bad",
+			RemoteSource:  remote,
+		}
+		if remote != nil {
+			m.HttpURL = "http://unused"
+		}
+		_, err = m.Init()
+		if !assert.NoError(t, err, "HTTP settings should be ignored without HttpURL") {
+			continue
+		}
+		assert.Nil(t, m.httpClient, "No http client should be built")
+		assert.Nil(t, m.proxiedHttpClient, "No proxied http client should be built")
+		m.Stop()
+	}
+	os.Remove(file.Name() + ".etag")
+}
+
+func TestHttpTriggerFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	defer os.Remove(file.Name() + ".etag")
+	trigger := file.Name() + ".trigger"
+	defer os.Remove(trigger)
+
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&fetches, 1)
+		resp.Write([]byte(fmt.Sprintf("n:\n  s: fetch %d\n", n)))
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: 5 * time.Millisecond,
+		HttpURL:          srv.URL,
+		HttpPollInterval: time.Hour,
+		HttpTriggerFile:  trigger,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	assert.Equal(t, "fetch 1", m.Next().(*TestCfg).N.S, "Config should be fetched on start")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "Config should not be fetched again without trigger")
+
+	if err := ioutil.WriteFile(trigger, nil, 0644); err != nil {
+		t.Fatalf("Unable to write trigger file: %s", err)
+	}
+	select {
+	case cfg := <-m.nextCfgCh:
+		assert.Equal(t, "fetch 2", cfg.(*TestCfg).N.S, "Trigger should cause fetch")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Trigger should cause fetch before next poll")
+	}
+	_, err = os.Stat(trigger)
+	assert.True(t, os.IsNotExist(err), "Trigger file should be removed")
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches), "Each trigger should cause a single fetch")
+}
+
+func TestRequireInitialHttpFetch(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	defer os.Remove(file.Name() + ".etag")
+
+	var fetches int32
+	var hang atomic.Value
+	hang.Store(false)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if hang.Load().(bool) {
+			time.Sleep(500 * time.Millisecond)
+		}
+		atomic.AddInt32(&fetches, 1)
+		resp.Write([]byte("n:\n  s: remote\n"))
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:                file.Name(),
+		HttpURL:                 srv.URL,
+		HttpPollInterval:        time.Hour,
+		RequireInitialHttpFetch: true,
+	}
+	cfg, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	assert.Equal(t, &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "remote",
+			I: FIXED_I,
+		},
+	}, cfg, "Init should return fetched config")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "Config should only be fetched once on start")
+	m.Stop()
+
+	hang.Store(true)
+	os.Remove(file.Name() + ".etag")
+	m = &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:                file.Name(),
+		HttpURL:                 srv.URL,
+		HttpTimeout:             50 * time.Millisecond,
+		RequireInitialHttpFetch: true,
+	}
+	_, err = m.Init()
+	assert.Error(t, err, "Failed initial fetch should fail Init")
+}
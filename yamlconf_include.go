@@ -0,0 +1,99 @@
+package yamlconf
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// includeDirective matches lines consisting of an !include directive, either
+// on its own, as the value of a key or as an item of a list.
+var includeDirective = regexp.MustCompile(`^(\s*)((?:- )?(?:[^#\s-][^#]*?:\s+)?)!include\s+(\S+)\s*$`)
+
+// resolveIncludes inlines the files referenced by !include directives in data,
+// which was read from path, appending the paths of all included files to
+// included.
+func (m *Manager) resolveIncludes(path string, data []byte, included *[]string) ([]byte, error) {
+	return m.inline(path, data, nil, included)
+}
+
+func (m *Manager) inline(path string, data []byte, including []string, included *[]string) ([]byte, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve absolute path of %s: %s", path, err)
+	}
+	for _, ancestor := range including {
+		if ancestor == absPath {
+			return nil, fmt.Errorf("Include cycle: %s", strings.Join(append(including, absPath), " -> "))
+		}
+	}
+	including = append(including, absPath)
+
+	var out bytes.Buffer
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		match := includeDirective.FindStringSubmatch(line)
+		if match == nil {
+			out.WriteString(line)
+			if i < len(lines)-1 {
+				out.WriteString("\n")
+			}
+			continue
+		}
+		indent, prefix, target := match[1], match[2], strings.Trim(match[3], `"'`)
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		content, err := m.readPath(target)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to include %s in %s: %s", target, path, err)
+		}
+		*included = append(*included, target)
+		content, err = m.inline(target, content, including, included)
+		if err != nil {
+			return nil, err
+		}
+
+		childIndent := indent
+		if prefix != "" {
+			// The included content goes on its own lines, indented below the
+			// key or list item that included it
+			out.WriteString(indent + strings.TrimRight(prefix, " ") + "\n")
+			keyStart := len(prefix) - len(strings.TrimPrefix(prefix, "- "))
+			childIndent += strings.Repeat(" ", keyStart+2)
+		}
+		for _, includedLine := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			if strings.TrimRight(includedLine, " \r") == "---" {
+				continue
+			}
+			if includedLine != "" {
+				out.WriteString(childIndent + includedLine)
+			}
+			out.WriteString("\n")
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// setIncludes records the files included in the config as last loaded,
+// watching any new ones if using the file watcher.
+func (m *Manager) setIncludes(included []string) {
+	m.includes = included
+	if m.watcher != nil {
+		m.watchIncludes(m.watcher)
+	}
+}
+
+// watchIncludes adds the files included in the config to the given watcher, so
+// that changes to them trigger reloads too.
+func (m *Manager) watchIncludes(watcher *fsnotify.Watcher) {
+	for _, path := range m.includes {
+		if err := watcher.Add(path); err != nil {
+			m.reportError(sourceDisk, fmt.Errorf("Unable to watch included file %s: %s", path, err))
+		}
+	}
+}
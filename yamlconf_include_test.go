@@ -0,0 +1,103 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Unable to create dir: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %s", name, err)
+		}
+	}
+	write("config.yaml", "version: 1\nn: !include shared/nested.yaml\n")
+	write("shared/nested.yaml", "s: !include s.yaml\ni: 5\n")
+	write("shared/s.yaml", "included twice\n")
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         filepath.Join(dir, "config.yaml"),
+		ReadOnly:         true,
+		EnableIncludes:   true,
+		FilePollInterval: pollInterval,
+	}
+	cfg, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.Equal(t, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "included twice",
+			I: 5,
+		},
+	}, cfg, "Includes should be resolved")
+
+	write("shared/s.yaml", "changed\n")
+	assert.Equal(t, "changed", m.Next().(*TestCfg).N.S, "Change to included file should be picked up")
+
+	assert.Equal(t, "a:\n  - 1\n  -\n      - x\n  - b:\n      y: 2\n", mustInline(t, m, dir, "a:\n  - 1\n  - !include list.yaml\n  - b: !include map.yaml\n", map[string]string{
+		"list.yaml": "- x\n",
+		"map.yaml":  "---\ny: 2\n",
+	}), "Includes should be indented below list items and keys")
+}
+
+func mustInline(t *testing.T, m *Manager, dir string, content string, files map[string]string) string {
+	for name, fileContent := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(fileContent), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %s", name, err)
+		}
+	}
+	var included []string
+	resolved, err := m.resolveIncludes(filepath.Join(dir, "test.yaml"), []byte(content), &included)
+	if err != nil {
+		t.Fatalf("Unable to resolve includes: %s", err)
+	}
+	return string(resolved)
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte("n: !include b.yaml\n"), 0644); err != nil {
+		t.Fatalf("Unable to write file: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte("s: x\ni: !include a.yaml\n"), 0644); err != nil {
+		t.Fatalf("Unable to write file: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:       filepath.Join(dir, "a.yaml"),
+		EnableIncludes: true,
+	}
+	_, err = m.Init()
+	if assert.Error(t, err, "Include cycle should be detected") {
+		assert.True(t, strings.Contains(err.Error(), "Include cycle"), "Unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,77 @@
+package yamlconf
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// interpolate expands ${NAME} placeholders in the given raw config if
+// Interpolate is set. $$ is an escaped $. Any other $, as in "price: $5", is
+// left alone.
+func (m *Manager) interpolate(data []byte) ([]byte, error) {
+	if !m.Interpolate {
+		return data, nil
+	}
+	var missing []string
+	var expanded bytes.Buffer
+	for i := 0; i < len(data); i++ {
+		if data[i] != '$' || i+1 == len(data) {
+			expanded.WriteByte(data[i])
+			continue
+		}
+		switch data[i+1] {
+		case '$':
+			expanded.WriteByte('$')
+			i++
+		case '{':
+			end := bytes.IndexByte(data[i+2:], '}')
+			if end < 0 {
+				// Unterminated, leave as is
+				expanded.WriteByte(data[i])
+				continue
+			}
+			name := string(data[i+2 : i+2+end])
+			value, found := m.expandVar(name)
+			if !found {
+				missing = append(missing, name)
+			}
+			expanded.WriteString(value)
+			i += 2 + end
+		default:
+			expanded.WriteByte(data[i])
+		}
+	}
+	if len(missing) > 0 && m.ErrorOnMissingVars {
+		return nil, fmt.Errorf("Missing variables %s", strings.Join(missing, ", "))
+	}
+	return expanded.Bytes(), nil
+}
+
+// expandVar returns the value of the placeholder with the given name, which
+// may specify a default like NAME:-default. It returns false if the variable
+// is missing and has no default.
+func (m *Manager) expandVar(name string) (string, bool) {
+	def, hasDefault := "", false
+	if i := strings.Index(name, ":-"); i >= 0 {
+		name, def, hasDefault = name[:i], name[i+2:], true
+	}
+	value, found := m.lookupVar(name)
+	if found && value != "" {
+		return value, true
+	}
+	if hasDefault {
+		return def, true
+	}
+	return value, found
+}
+
+// lookupVar looks up the named variable in Vars, falling back to the
+// environment.
+func (m *Manager) lookupVar(name string) (string, bool) {
+	if value, found := m.Vars[name]; found {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
@@ -0,0 +1,89 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestInterpolate(t *testing.T) {
+	os.Setenv("YAMLCONF_TEST_DATA_DIR", "/from/env")
+	defer os.Unsetenv("YAMLCONF_TEST_DATA_DIR")
+	os.Setenv("YAMLCONF_TEST_SHADOWED", "from env")
+	defer os.Unsetenv("YAMLCONF_TEST_SHADOWED")
+
+	m := &Manager{
+		Interpolate: true,
+		Vars: map[string]string{
+			"YAMLCONF_TEST_SHADOWED": "from vars",
+			"YAMLCONF_TEST_EMPTY":    "",
+		},
+	}
+	interpolate := func(s string) string {
+		result, err := m.interpolate([]byte(s))
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		return string(result)
+	}
+	assert.Equal(t, "dir: /from/env/cache", interpolate("dir: ${YAMLCONF_TEST_DATA_DIR}/cache"))
+	assert.Equal(t, "s: from vars", interpolate("s: ${YAMLCONF_TEST_SHADOWED}"), "Vars should take precedence")
+	assert.Equal(t, "s: fallback", interpolate("s: ${YAMLCONF_TEST_MISSING:-fallback}"))
+	assert.Equal(t, "s: fallback", interpolate("s: ${YAMLCONF_TEST_EMPTY:-fallback}"), "Empty should use default")
+	assert.Equal(t, "s: /from/env", interpolate("s: ${YAMLCONF_TEST_DATA_DIR:-fallback}"))
+	assert.Equal(t, "s: ", interpolate("s: ${YAMLCONF_TEST_MISSING}"), "Missing should be empty")
+	assert.Equal(t, "s: ${LITERAL} costs $5", interpolate("s: $${LITERAL} costs $$5"), "$$ should be literal")
+	assert.Equal(t, "price: $5", interpolate("price: $5"), "Unbraced $ should be literal")
+	assert.Equal(t, "pass: ab$cd", interpolate("pass: ab$cd"), "Unbraced $ should be literal")
+	assert.Equal(t, "s: a$", interpolate("s: a$"), "Trailing $ should be literal")
+	assert.Equal(t, "s: ${UNTERMINATED", interpolate("s: ${UNTERMINATED"), "Unterminated placeholder should be literal")
+
+	m.ErrorOnMissingVars = true
+	_, err := m.interpolate([]byte("s: ${YAMLCONF_TEST_MISSING}"))
+	assert.Error(t, err, "Missing variable should fail")
+	assert.Equal(t, "price: $5\npass: ab$cd", interpolate("price: $5\npass: ab$cd"), "Unbraced $ should not count as missing variable")
+	assert.Equal(t, "s: ", interpolate("s: ${YAMLCONF_TEST_EMPTY}"), "Variable set to empty is not missing")
+	assert.Equal(t, "s: fallback", interpolate("s: ${YAMLCONF_TEST_MISSING:-fallback}"), "Default should avoid error")
+
+	m.Interpolate = false
+	assert.Equal(t, "s: ${YAMLCONF_TEST_MISSING}", interpolate("s: ${YAMLCONF_TEST_MISSING}"), "Should only interpolate if enabled")
+}
+
+func TestInterpolateOnLoad(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	if err := ioutil.WriteFile(file.Name(), []byte("n:\n  s: ${NAME}\n  i: ${I:-55}\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:    file.Name(),
+		Interpolate: true,
+		Vars:        map[string]string{"NAME": "interpolated"},
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	assert.Equal(t, &Nested{S: "interpolated", I: 55}, m.cfg.(*TestCfg).N)
+
+	m.ErrorOnMissingVars = true
+	delete(m.Vars, "NAME")
+	if err := ioutil.WriteFile(file.Name(), []byte("n:\n  s: ${NAME}\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	_, err = m.reloadFromDisk()
+	assert.Error(t, err, "Missing variable should fail loading")
+	assert.Equal(t, "interpolated", m.cfg.(*TestCfg).N.S, "Current config should be kept")
+}
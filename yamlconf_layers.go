@@ -0,0 +1,153 @@
+package yamlconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/getlantern/yaml"
+)
+
+// loadBase loads the config merged from all files but FilePath, to which
+// updates are written (see FilePaths and FragmentDir). It returns nil if
+// FilePath is the only file. Environment overrides aren't applied, since
+// they're left out of what's written too (see withoutEnv).
+func (m *Manager) loadBase() (Config, error) {
+	paths, err := m.filePaths()
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) < 2 {
+		return nil, nil
+	}
+	base, err := m.newConfig()
+	if err != nil {
+		return nil, err
+	}
+	var included []string
+	for _, path := range paths[:len(paths)-1] {
+		data, err := m.readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err = m.decrypt(path, data)
+		if err != nil {
+			return nil, err
+		}
+		if m.EnableIncludes {
+			data, err = m.resolveIncludes(path, data, &included)
+			if err != nil {
+				return nil, err
+			}
+		}
+		data, err = m.interpolate(data)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to interpolate config from %s: %s", path, err)
+		}
+		if err := m.unmarshal(data, base); err != nil {
+			return nil, newParseError(path, data, err)
+		}
+	}
+	m.applyDefaults(base)
+	return base, nil
+}
+
+// marshalLayer marshals cfg for writing to FilePath. When the config is merged
+// from several files, only the values that differ from the merge of the other
+// files are kept, so that FilePath doesn't shadow later changes to them. The
+// version is always kept (unless marshal leaves it out). With a custom Marshal
+// the whole config is written, since its output can't be diffed.
+func (m *Manager) marshalLayer(cfg Config, marshal func(Config) ([]byte, error)) ([]byte, error) {
+	if m.Marshal != nil {
+		return marshal(cfg)
+	}
+	base, err := m.loadBase()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load config underlying %s: %s", m.FilePath, err)
+	}
+	if base == nil {
+		return marshal(cfg)
+	}
+	// Make sure the versions differ so that the version isn't dropped
+	base.SetVersion(cfg.GetVersion() - 1)
+	full, err := marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	underlying, err := marshal(base)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Format == FormatJSON {
+		var fullValues, baseValues map[string]interface{}
+		if err := json.Unmarshal(full, &fullValues); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(underlying, &baseValues); err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(diffJSON(fullValues, baseValues), "", "  ")
+	}
+	var fullValues, baseValues yaml.MapSlice
+	if err := yaml.Unmarshal(full, &fullValues); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(underlying, &baseValues); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(diffYAML(fullValues, baseValues))
+}
+
+// diffYAML returns the items of values that differ from those in base,
+// recursing into nested mappings.
+func diffYAML(values yaml.MapSlice, base yaml.MapSlice) yaml.MapSlice {
+	baseValues := make(map[interface{}]interface{}, len(base))
+	for _, item := range base {
+		baseValues[item.Key] = item.Value
+	}
+	result := yaml.MapSlice{}
+	for _, item := range values {
+		baseValue, found := baseValues[item.Key]
+		if found {
+			if reflect.DeepEqual(item.Value, baseValue) {
+				continue
+			}
+			nested, isMap := item.Value.(yaml.MapSlice)
+			baseNested, baseIsMap := baseValue.(yaml.MapSlice)
+			if isMap && baseIsMap {
+				diff := diffYAML(nested, baseNested)
+				if len(diff) == 0 {
+					continue
+				}
+				item.Value = diff
+			}
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// diffJSON is like diffYAML, for JSON objects.
+func diffJSON(values map[string]interface{}, base map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range values {
+		baseValue, found := base[key]
+		if found {
+			if reflect.DeepEqual(value, baseValue) {
+				continue
+			}
+			nested, isMap := value.(map[string]interface{})
+			baseNested, baseIsMap := baseValue.(map[string]interface{})
+			if isMap && baseIsMap {
+				diff := diffJSON(nested, baseNested)
+				if len(diff) == 0 {
+					continue
+				}
+				value = diff
+			}
+		}
+		result[key] = value
+	}
+	return result
+}
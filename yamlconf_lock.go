@@ -0,0 +1,96 @@
+package yamlconf
+
+import (
+	"fmt"
+	"os"
+)
+
+// openLockFile is os.OpenFile, replaceable in tests
+var openLockFile = os.OpenFile
+
+// lockPath returns the path of the file used for detecting other Managers
+// using the same FilePath.
+func (m *Manager) lockPath() string {
+	return m.FilePath + ".lock"
+}
+
+// lockFile takes an advisory lock on FilePath to detect other Managers (in
+// this or other processes) writing to it. If another Manager holds the lock,
+// it fails if LockFile is set and logs a warning otherwise.
+func (m *Manager) lockFile() error {
+	if m.ReadOnly || m.FileStore != nil {
+		return nil
+	}
+	for {
+		file, locked, err := m.tryLockFile()
+		if err != nil {
+			return err
+		}
+		if !locked {
+			err := fmt.Errorf("%s is in use by another Manager, which will result in conflicting writes", m.FilePath)
+			if m.LockFile {
+				return err
+			}
+			m.logger().Errorf("WARNING: %s", err)
+			return nil
+		}
+		if file != nil {
+			m.lock = file
+			return nil
+		}
+	}
+}
+
+// tryLockFile opens and locks the lock file, returning false if another
+// Manager holds the lock. unlockFile removes the lock file before releasing
+// the lock, so we might lock a file that has since been removed (and possibly
+// replaced by a file locked by another Manager). In that case, no file is
+// returned and the caller should try again.
+func (m *Manager) tryLockFile() (*os.File, bool, error) {
+	path := m.lockPath()
+	file, err := openLockFile(path, os.O_RDWR|os.O_CREATE, m.FileMode)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to open lock file %s: %s", path, err)
+	}
+	locked, err := tryLock(file)
+	if err != nil || !locked {
+		file.Close()
+		if err != nil {
+			return nil, false, fmt.Errorf("Unable to lock %s: %s", path, err)
+		}
+		return nil, false, nil
+	}
+	lockedInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, false, fmt.Errorf("Unable to stat lock file %s: %s", path, err)
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		file.Close()
+		return nil, false, fmt.Errorf("Unable to stat lock file %s: %s", path, err)
+	}
+	if err != nil || !os.SameFile(lockedInfo, pathInfo) {
+		m.logger().Debugf("Lock file %s was replaced while locking, retrying", path)
+		file.Close()
+		return nil, true, nil
+	}
+	return file, true, nil
+}
+
+// unlockFile releases the lock taken by lockFile, if any.
+func (m *Manager) unlockFile() {
+	if m.lock == nil {
+		return
+	}
+	// Remove the lock file before releasing the lock so that it doesn't stick
+	// around. Managers that opened it in the meantime notice that it's gone
+	// once they get the lock (see tryLockFile).
+	if err := os.Remove(m.lockPath()); err != nil {
+		m.logger().Debugf("Unable to remove lock file: %s", err)
+	}
+	if err := m.lock.Close(); err != nil {
+		m.logger().Debugf("Unable to close lock file: %s", err)
+	}
+	m.lock = nil
+}
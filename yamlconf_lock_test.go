@@ -0,0 +1,108 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	newManager := func(lock bool) *Manager {
+		return &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath: path,
+			LockFile: lock,
+		}
+	}
+
+	first := newManager(true)
+	_, err = first.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+
+	second := newManager(true)
+	_, err = second.Init()
+	assert.Error(t, err, "Second manager on same file should detect contention")
+
+	warnOnly := newManager(false)
+	_, err = warnOnly.Init()
+	if assert.NoError(t, err, "Contention should only be logged unless LockFile is set") {
+		warnOnly.Stop()
+	}
+
+	first.Stop()
+	_, err = os.Stat(path + ".lock")
+	assert.True(t, os.IsNotExist(err), "Lock file should be removed on stop")
+
+	third := newManager(true)
+	_, err = third.Init()
+	if assert.NoError(t, err, "Lock should be released on stop") {
+		third.Stop()
+	}
+}
+
+func TestLockFileReplacedWhileLocking(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Open files can't be removed on Windows")
+	}
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	// Simulate the lock file being removed by its previous owner and
+	// recreated and locked by another Manager between opening and locking
+	var other *os.File
+	openLockFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		file, err := os.OpenFile(name, flag, perm)
+		if err != nil || other != nil {
+			return file, err
+		}
+		if err := os.Remove(name); err != nil {
+			t.Fatalf("Unable to remove lock file: %s", err)
+		}
+		other, err = os.OpenFile(name, flag, perm)
+		if err != nil {
+			t.Fatalf("Unable to recreate lock file: %s", err)
+		}
+		locked, err := tryLock(other)
+		if !locked || err != nil {
+			t.Fatalf("Unable to lock recreated lock file: %s", err)
+		}
+		return file, nil
+	}
+	defer func() {
+		openLockFile = os.OpenFile
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: path,
+		LockFile: true,
+	}
+	_, err = m.Init()
+	if assert.Error(t, err, "Lock on removed lock file should not count") {
+		m.Stop()
+	}
+	if other != nil {
+		other.Close()
+	}
+}
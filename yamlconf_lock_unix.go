@@ -0,0 +1,18 @@
+//go:build !windows
+
+package yamlconf
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive lock on the given file without blocking,
+// returning false if it's already locked.
+func tryLock(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,44 @@
+package yamlconf
+
+// Metrics receives notifications about the Manager's activity, for example in
+// order to maintain counters for monitoring. Implementations must be safe for
+// concurrent use and should return promptly.
+type Metrics interface {
+	// FileReloaded is called when a changed config was loaded from disk.
+	FileReloaded()
+
+	// FileReloadError is called when reloading the config from disk failed.
+	FileReloadError()
+
+	// HttpFetched is called when a config was fetched from HttpURL (or
+	// RemoteSource).
+	HttpFetched()
+
+	// HttpNotModified is called when HttpURL (or RemoteSource) reported that
+	// the config hasn't changed.
+	HttpNotModified()
+
+	// HttpError is called when fetching the config from HttpURL (or
+	// RemoteSource) failed.
+	HttpError()
+
+	// ConfigChanged is called whenever the config changes, regardless of
+	// source.
+	ConfigChanged()
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) FileReloaded()    {}
+func (noopMetrics) FileReloadError() {}
+func (noopMetrics) HttpFetched()     {}
+func (noopMetrics) HttpNotModified() {}
+func (noopMetrics) HttpError()       {}
+func (noopMetrics) ConfigChanged()   {}
+
+func (m *Manager) metrics() Metrics {
+	if m.Metrics == nil {
+		return noopMetrics{}
+	}
+	return m.Metrics
+}
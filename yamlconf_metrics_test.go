@@ -0,0 +1,103 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+type countingMetrics struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func (cm *countingMetrics) inc(name string) {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.counts[name]++
+}
+
+func (cm *countingMetrics) get(name string) int {
+	cm.Lock()
+	defer cm.Unlock()
+	return cm.counts[name]
+}
+
+func (cm *countingMetrics) FileReloaded()    { cm.inc("FileReloaded") }
+func (cm *countingMetrics) FileReloadError() { cm.inc("FileReloadError") }
+func (cm *countingMetrics) HttpFetched()     { cm.inc("HttpFetched") }
+func (cm *countingMetrics) HttpNotModified() { cm.inc("HttpNotModified") }
+func (cm *countingMetrics) HttpError()       { cm.inc("HttpError") }
+func (cm *countingMetrics) ConfigChanged()   { cm.inc("ConfigChanged") }
+
+func TestMetrics(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(status)
+		if status == http.StatusOK {
+			resp.Write([]byte("n:\n  s: remote\n"))
+		}
+	}))
+	defer srv.Close()
+
+	metrics := &countingMetrics{counts: make(map[string]int)}
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		HttpURL:  srv.URL,
+		Metrics:  metrics,
+	}
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	m.httpClient, err = m.buildHttpClient()
+	if err != nil {
+		t.Fatalf("Unable to build http client: %s", err)
+	}
+
+	assert.True(t, m.pollRemote(m.fetchRemote(m.etag)))
+	status = http.StatusNotModified
+	assert.False(t, m.pollRemote(m.fetchRemote(m.etag)))
+	status = http.StatusNotFound
+	assert.False(t, m.pollRemote(m.fetchRemote(m.etag)))
+
+	saveConfig(t, file, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "edited",
+			I: FIXED_I,
+		},
+	})
+	assert.True(t, m.pollFile())
+	if err := ioutil.WriteFile(file.Name(), []byte("not: [valid"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	assert.False(t, m.pollFile())
+
+	assert.Equal(t, 1, metrics.get("HttpFetched"))
+	assert.Equal(t, 1, metrics.get("HttpNotModified"))
+	assert.Equal(t, 1, metrics.get("HttpError"))
+	assert.Equal(t, 1, metrics.get("FileReloaded"))
+	assert.Equal(t, 1, metrics.get("FileReloadError"))
+
+	previous := m.getCfg()
+	m.changed(SourceUpdate, previous)
+	assert.Equal(t, 1, metrics.get("ConfigChanged"))
+}
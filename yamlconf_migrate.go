@@ -0,0 +1,101 @@
+package yamlconf
+
+import (
+	"fmt"
+	"sort"
+)
+
+// upgrade is an upgrade registered with RegisterUpgrade.
+type upgrade struct {
+	to int
+	fn func(old, new Config) error
+}
+
+// RegisterUpgrade registers a function for upgrading configs of version from to
+// version to, which must be later. Unlike Migrations, which modify a config in
+// place, fn reads the config old and fills in new, a fresh config obtained
+// from EmptyConfig. This allows the shape of the config to change between
+// versions, for example by having EmptyConfig's type capture keys that have
+// since been removed in an inline map, from which fn moves them elsewhere.
+//
+// When a config is loaded from disk, upgrades are chained for as long as one
+// is registered for the config's version, after which Migrations are applied.
+// Registering another upgrade from the same version replaces the previous one.
+// RegisterUpgrade must be called before Init.
+func (m *Manager) RegisterUpgrade(from, to int, fn func(old, new Config) error) {
+	if m.upgrades == nil {
+		m.upgrades = make(map[int]upgrade)
+	}
+	m.upgrades[from] = upgrade{to, fn}
+}
+
+// checkUpgrades makes sure that all registered upgrades move forward, so that
+// chaining them terminates.
+func (m *Manager) checkUpgrades() error {
+	for from, u := range m.upgrades {
+		if u.to <= from {
+			return fmt.Errorf("Upgrade from version %d must be to a later version, not %d", from, u.to)
+		}
+	}
+	return nil
+}
+
+// migrate applies any registered upgrades and applicable Migrations to the
+// given config, returning the resulting config and true if it was migrated.
+// If a migration fails, the config may have been partially migrated and
+// should be discarded.
+func (m *Manager) migrate(cfg Config) (Config, bool, error) {
+	cfg, upgraded, err := m.upgrade(cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(m.Migrations) == 0 {
+		return cfg, upgraded, nil
+	}
+	versions := make([]int, 0, len(m.Migrations))
+	for version := range m.Migrations {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	from := cfg.GetVersion()
+	latest := versions[len(versions)-1]
+	if from >= latest {
+		return cfg, upgraded, nil
+	}
+	for _, version := range versions {
+		if version <= from {
+			continue
+		}
+		m.logger().Debugf("Migrating config to version %d", version)
+		if err := m.Migrations[version](cfg); err != nil {
+			return nil, false, fmt.Errorf("Migration to version %d failed: %s", version, err)
+		}
+	}
+	cfg.SetVersion(latest)
+	return cfg, true, nil
+}
+
+// upgrade chains registered upgrades starting at the given config's version,
+// returning the upgraded config and true if any upgrade was applied.
+func (m *Manager) upgrade(cfg Config) (Config, bool, error) {
+	upgraded := false
+	for {
+		from := cfg.GetVersion()
+		u, found := m.upgrades[from]
+		if !found {
+			return cfg, upgraded, nil
+		}
+		m.logger().Debugf("Upgrading config from version %d to %d", from, u.to)
+		next, err := m.newConfig()
+		if err != nil {
+			return nil, false, err
+		}
+		if err := u.fn(cfg, next); err != nil {
+			return nil, false, fmt.Errorf("Upgrade from version %d to %d failed: %s", from, u.to, err)
+		}
+		next.SetVersion(u.to)
+		cfg = next
+		upgraded = true
+	}
+}
@@ -0,0 +1,246 @@
+package yamlconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestMigrations(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	saveConfig(t, file, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "v1",
+			I: FIXED_I,
+		},
+	})
+
+	var applied []int
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		Migrations: map[int]func(cfg Config) error{
+			1: func(cfg Config) error {
+				applied = append(applied, 1)
+				return nil
+			},
+			3: func(cfg Config) error {
+				applied = append(applied, 3)
+				cfg.(*TestCfg).N.S += "->v3"
+				return nil
+			},
+			2: func(cfg Config) error {
+				applied = append(applied, 2)
+				cfg.(*TestCfg).N.S += "->v2"
+				return nil
+			},
+		},
+	}
+	first, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	assert.Equal(t, []int{2, 3}, applied, "Only newer migrations should be applied, in order")
+	assert.Equal(t, &TestCfg{
+		Version: 3,
+		N: &Nested{
+			S: "v1->v2->v3",
+			I: FIXED_I,
+		},
+	}, first, "Config should be migrated to v3")
+	assertSavedConfigEquals(t, file, first.(*TestCfg))
+}
+
+func TestFailedMigration(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	original := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "v1",
+			I: FIXED_I,
+		},
+	}
+	saveConfig(t, file, original)
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		Migrations: map[int]func(cfg Config) error{
+			2: func(cfg Config) error {
+				return fmt.Errorf("I don't wanna migrate")
+			},
+		},
+	}
+	_, err = m.Init()
+	assert.Error(t, err, "Failed migration should fail Init")
+	assertSavedConfigEquals(t, file, original)
+}
+
+// LegacyCfg captures keys that are no longer part of the config in Legacy, so
+// that upgrades can move them elsewhere.
+type LegacyCfg struct {
+	Version int
+	N       *Nested
+	Legacy  map[string]interface{} `yaml:",inline"`
+}
+
+func (c *LegacyCfg) GetVersion() int {
+	return c.Version
+}
+
+func (c *LegacyCfg) SetVersion(version int) {
+	c.Version = version
+}
+
+func (c *LegacyCfg) ApplyDefaults() {
+	if c.N == nil {
+		c.N = &Nested{}
+	}
+}
+
+func TestRegisterUpgrade(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	// Version 1 had flat name and size keys
+	if err := ioutil.WriteFile(file.Name(), []byte("version: 1\nname: legacy\nsize: 5\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	var applied []string
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &LegacyCfg{}
+		},
+		FilePath: file.Name(),
+		Migrations: map[int]func(cfg Config) error{
+			5: func(cfg Config) error {
+				applied = append(applied, "migration 5")
+				cfg.(*LegacyCfg).N.S += "->v5"
+				return nil
+			},
+		},
+	}
+	m.RegisterUpgrade(3, 4, func(old, new Config) error {
+		applied = append(applied, "3->4")
+		n := *old.(*LegacyCfg).N
+		n.S += "->v4"
+		new.(*LegacyCfg).N = &n
+		return nil
+	})
+	m.RegisterUpgrade(1, 2, func(old, new Config) error {
+		applied = append(applied, "1->2")
+		new.(*LegacyCfg).N = &Nested{
+			S: old.(*LegacyCfg).Legacy["name"].(string),
+		}
+		new.(*LegacyCfg).Legacy = map[string]interface{}{"size": old.(*LegacyCfg).Legacy["size"]}
+		return nil
+	})
+	m.RegisterUpgrade(2, 3, func(old, new Config) error {
+		applied = append(applied, "2->3")
+		new.(*LegacyCfg).N = &Nested{
+			S: old.(*LegacyCfg).N.S + "->v3",
+			I: old.(*LegacyCfg).Legacy["size"].(int),
+		}
+		return nil
+	})
+	cfg, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	assert.Equal(t, []string{"1->2", "2->3", "3->4", "migration 5"}, applied, "Upgrades should be chained in order, followed by migrations")
+	assert.Equal(t, 5, cfg.GetVersion())
+	assert.Equal(t, &Nested{S: "legacy->v3->v4->v5", I: 5}, cfg.(*LegacyCfg).N)
+	assert.Empty(t, cfg.(*LegacyCfg).Legacy, "Legacy keys should be gone after upgrading")
+	bod, err := ioutil.ReadFile(file.Name())
+	if assert.NoError(t, err) {
+		assert.False(t, strings.Contains(string(bod), "name:"), "Upgraded config should be saved")
+		assert.Contains(t, string(bod), "s: legacy->v3->v4->v5")
+	}
+}
+
+func TestFailedUpgrade(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	original := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "v1",
+			I: FIXED_I,
+		},
+	}
+	saveConfig(t, file, original)
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	m.RegisterUpgrade(1, 2, func(old, new Config) error {
+		return fmt.Errorf("I don't wanna upgrade")
+	})
+	_, err = m.Init()
+	if assert.Error(t, err, "Failed upgrade should fail Init") {
+		assert.Contains(t, err.Error(), "Upgrade from version 1 to 2 failed")
+	}
+	assertSavedConfigEquals(t, file, original)
+
+	m = &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	m.RegisterUpgrade(2, 2, func(old, new Config) error {
+		return nil
+	})
+	_, err = m.Init()
+	assert.Error(t, err, "Upgrade that doesn't move forward should fail Init")
+}
@@ -0,0 +1,226 @@
+package yamlconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// RemoteSource is a source from which the Manager periodically fetches the
+// config, for example an HTTP server (see HttpURL), an object store or a custom
+// service.
+type RemoteSource interface {
+	// Fetch fetches the config. etag identifies the config last fetched from
+	// this source (empty if none). If the config hasn't changed since then,
+	// Fetch returns changed == false. Otherwise, it returns the config's body
+	// (in the Manager's Format) along with a new etag identifying it.
+	Fetch(etag string) (body []byte, newETag string, changed bool, err error)
+}
+
+// remoteSource returns the RemoteSource from which to fetch the config, or nil
+// if there is none.
+func (m *Manager) remoteSource() RemoteSource {
+	if m.RemoteSource != nil {
+		return m.RemoteSource
+	}
+	if m.HttpURL != "" {
+		return &httpSource{m: m}
+	}
+	return nil
+}
+
+// remoteName describes the remote source for use in logs and errors.
+func (m *Manager) remoteName() string {
+	if m.RemoteSource != nil {
+		return "remote source"
+	}
+	return m.HttpURL
+}
+
+// remoteFetch is the result of fetching from the remote source.
+type remoteFetch struct {
+	body    []byte
+	etag    string
+	changed bool
+	err     error
+
+	// fallbackURL and fallbackETag are set if the config came from one of
+	// HttpFallbackURLs (see httpSource.Fetch)
+	fallbackURL  string
+	fallbackETag string
+}
+
+// fetchRemote fetches the config from the remote source, given the etag of
+// the config last fetched. It doesn't touch the Manager's state, so it can run
+// in the background (see startRemoteFetch).
+func (m *Manager) fetchRemote(etag string) *remoteFetch {
+	source := m.remoteSource()
+	body, newETag, changed, err := source.Fetch(etag)
+	fetched := &remoteFetch{body: body, etag: newETag, changed: changed, err: err}
+	if hs, ok := source.(*httpSource); ok {
+		fetched.fallbackURL, fetched.fallbackETag = hs.fallbackURL, hs.fallbackETag
+	}
+	return fetched
+}
+
+// startRemoteFetch fetches the config from the remote source in the
+// background, so that slow responses and retries (see HttpMaxRetries) don't
+// hold up updates, reloads or stopping. The result is delivered on the
+// returned channel for applyRemoteConfig. It returns nil if paused.
+func (m *Manager) startRemoteFetch() chan *remoteFetch {
+	if m.IsPaused() {
+		m.logger().Trace("Paused, not fetching config")
+		return nil
+	}
+	resultCh := make(chan *remoteFetch, 1)
+	etag := m.etag
+	go func() {
+		resultCh <- m.fetchRemote(etag)
+	}()
+	return resultCh
+}
+
+// fetchRemoteConfig fetches the config from the remote source and, if it
+// changed, saves it to disk and makes it current.
+func (m *Manager) fetchRemoteConfig() (bool, error) {
+	return m.applyRemoteConfig(m.fetchRemote(m.etag))
+}
+
+// applyRemoteConfig saves the config fetched from the remote source to disk and
+// makes it current, if it changed.
+func (m *Manager) applyRemoteConfig(fetched *remoteFetch) (bool, error) {
+	bytes, etag, changed, err := fetched.body, fetched.etag, fetched.changed, fetched.err
+	if err != nil {
+		return false, err
+	}
+	if !changed {
+		m.logger().Trace("Config unchanged remotely")
+		m.metrics().HttpNotModified()
+		return false, nil
+	}
+
+	if m.HttpTransform != nil {
+		bytes, err = m.HttpTransform(bytes)
+		if err != nil {
+			return false, fmt.Errorf("Unable to transform config from %s: %s", m.remoteName(), err)
+		}
+	}
+
+	var cfg Config
+	if m.HttpMerge {
+		cfg, err = m.copy(m.getCfg())
+	} else {
+		cfg, err = m.newConfig()
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := m.checkStrict(bytes, cfg); err != nil {
+		return false, fmt.Errorf("Invalid config from %s: %s", m.remoteName(), err)
+	}
+	err = m.unmarshal(bytes, cfg)
+	if err != nil {
+		return false, newParseError(m.remoteName(), bytes, err)
+	}
+	if err := m.applyEnv(cfg); err != nil {
+		return false, err
+	}
+	m.applyDefaults(cfg)
+	if err := m.afterLoad(cfg); err != nil {
+		return false, fmt.Errorf("Config from %s was rejected: %s", m.remoteName(), err)
+	}
+
+	changed, err = m.saveToDiskAndUpdate(cfg)
+	if err != nil {
+		return false, err
+	}
+	m.commitFallbackETag(fetched)
+	m.metrics().HttpFetched()
+	if changed {
+		if m.RemoteSource != nil {
+			m.setLoadedFrom(sourceRemote)
+		} else {
+			m.setLoadedFrom(sourceHttp)
+		}
+	}
+	if etag != m.etag {
+		m.etag = etag
+		m.saveETag()
+	}
+	return changed, nil
+}
+
+// etagPath returns the path of the file in which the etag of the config last
+// fetched remotely is persisted.
+func (m *Manager) etagPath() string {
+	return m.FilePath + ".etag"
+}
+
+// loadETag restores the etag persisted by a previous run, if any, so that the
+// first fetch after a restart doesn't needlessly download the config again. A
+// missing or corrupt etag file just results in a full fetch.
+func (m *Manager) loadETag() {
+	bytes, err := ioutil.ReadFile(m.etagPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.logger().Debugf("Unable to read etag, will fetch full config: %s", err)
+		}
+		return
+	}
+	etag := strings.TrimSpace(string(bytes))
+	if !isValidETag(etag) {
+		m.logger().Debugf("Ignoring corrupt etag in %s", m.etagPath())
+		return
+	}
+	m.etag = etag
+}
+
+// saveETag persists the current etag alongside the config file.
+func (m *Manager) saveETag() {
+	if m.ReadOnly {
+		return
+	}
+	if m.etag == "" {
+		if err := os.Remove(m.etagPath()); err != nil && !os.IsNotExist(err) {
+			m.logger().Debugf("Unable to remove etag file: %s", err)
+		}
+		return
+	}
+	if err := ioutil.WriteFile(m.etagPath(), []byte(m.etag+"\n"), m.FileMode); err != nil {
+		m.logger().Errorf("Unable to save etag: %s", err)
+	}
+}
+
+func isValidETag(etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for i := 0; i < len(etag); i++ {
+		if etag[i] < 0x20 || etag[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// httpTriggered checks whether HttpTriggerFile exists and, if so, consumes it
+// by removing it. While paused, the trigger is left in place so that the fetch
+// happens once the Manager is resumed.
+func (m *Manager) httpTriggered() bool {
+	if m.IsPaused() {
+		return false
+	}
+	if _, err := os.Stat(m.HttpTriggerFile); err != nil {
+		if !os.IsNotExist(err) {
+			m.reportError(sourceRemote, fmt.Errorf("Unable to check trigger file %s: %s", m.HttpTriggerFile, err))
+		}
+		return false
+	}
+	if err := os.Remove(m.HttpTriggerFile); err != nil && !os.IsNotExist(err) {
+		// Don't fetch, otherwise we'd fetch on every check
+		m.reportError(sourceRemote, fmt.Errorf("Unable to remove trigger file %s: %s", m.HttpTriggerFile, err))
+		return false
+	}
+	return true
+}
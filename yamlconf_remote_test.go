@@ -0,0 +1,124 @@
+package yamlconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// memorySource is a RemoteSource that serves a config held in memory.
+type memorySource struct {
+	mx      sync.Mutex
+	body    string
+	version int
+	etags   []string
+}
+
+func (s *memorySource) set(body string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.body = body
+	s.version++
+}
+
+func (s *memorySource) Fetch(etag string) ([]byte, string, bool, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.etags = append(s.etags, etag)
+	current := fmt.Sprint(s.version)
+	if etag == current {
+		return nil, etag, false, nil
+	}
+	return []byte(s.body), current, true, nil
+}
+
+func TestRemoteSource(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	defer os.Remove(file.Name() + ".etag")
+
+	source := &memorySource{}
+	source.set("n:\n  s: first\n")
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		RemoteSource:     source,
+		HttpPollInterval: pollInterval,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	updated := m.Next()
+	assert.Equal(t, "first", updated.(*TestCfg).N.S, "Config should come from remote source")
+	assertSavedConfigEquals(t, file, updated.(*TestCfg))
+	assert.Equal(t, "remote", m.LastLoadedFrom(), "Config should come from remote source")
+
+	source.set("n:\n  s: second\n")
+	updated = m.Next()
+	assert.Equal(t, "second", updated.(*TestCfg).N.S, "Changed config should be picked up from remote source")
+
+	source.mx.Lock()
+	defer source.mx.Unlock()
+	assert.Equal(t, "", source.etags[0], "First fetch should not have an etag")
+	assert.Equal(t, "1", source.etags[1], "Subsequent fetches should pass the last etag")
+}
+
+func TestHttpMerge(t *testing.T) {
+	for _, merge := range []bool{false, true} {
+		file, err := ioutil.TempFile("", "yamlconf_test_")
+		if err != nil {
+			t.Fatalf("Unable to create temp file: %s", err)
+		}
+		defer os.Remove(file.Name())
+		saveConfig(t, file, &TestCfg{
+			Version: 1,
+			N: &Nested{
+				S: "local",
+				I: FIXED_I,
+			},
+		})
+
+		source := &memorySource{}
+		source.set("n:\n  i: 7\n")
+		m := &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath:     file.Name(),
+			RemoteSource: source,
+			HttpMerge:    merge,
+		}
+		if err := m.loadFromDisk(); err != nil {
+			t.Fatalf("Unable to load config: %s", err)
+		}
+		changed, err := m.fetchRemoteConfig()
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.True(t, changed)
+		cfg := m.getCfg().(*TestCfg)
+		assert.Equal(t, 7, cfg.N.I, "Remote field should be applied")
+		if merge {
+			assert.Equal(t, "local", cfg.N.S, "Local field should survive merge")
+		} else {
+			assert.Equal(t, "", cfg.N.S, "Local field should be replaced")
+		}
+		assertSavedConfigEquals(t, file, cfg)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestReloadOnSignal(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: 1 * time.Hour,
+		ReloadOnSignal:   syscall.SIGHUP,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	saveConfig(t, file, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "signaled",
+			I: FIXED_I,
+		},
+	})
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("Unable to send signal: %s", err)
+	}
+
+	updated := make(chan Config)
+	go func() {
+		updated <- m.Next()
+	}()
+	select {
+	case cfg := <-updated:
+		assert.Equal(t, "signaled", cfg.(*TestCfg).N.S, "Signal should trigger reload")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Signal should trigger reload")
+	}
+}
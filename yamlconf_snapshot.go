@@ -0,0 +1,56 @@
+package yamlconf
+
+import (
+	"fmt"
+)
+
+// Snapshot returns the current config, marshaled in the Manager's Format, for
+// later use with Restore (e.g. to roll back a risky change).
+func (m *Manager) Snapshot() ([]byte, error) {
+	bytes, err := m.marshal(m.getCfg())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to marshal snapshot: %s", err)
+	}
+	return bytes, nil
+}
+
+// Restore replaces the current config with one previously obtained from
+// Snapshot. The restored config is processed like any other update, so it is
+// validated, saved and published with a new version. Restoring a snapshot
+// identical to the current config does nothing.
+func (m *Manager) Restore(snapshot []byte) error {
+	cfg, err := m.newConfig()
+	if err != nil {
+		return err
+	}
+	if err := m.unmarshal(snapshot, cfg); err != nil {
+		return fmt.Errorf("Unable to unmarshal snapshot: %s", err)
+	}
+	return m.submit(&delta{replacement: cfg})
+}
+
+// RawBytes returns the contents of the config file as last loaded or saved,
+// including formatting and comments (decrypted, if using a Cipher). If
+// FreshRawBytes is set, the file is read again instead. Like Current(), it's
+// safe to call concurrently with updates.
+func (m *Manager) RawBytes() ([]byte, error) {
+	if m.FreshRawBytes {
+		data, err := m.readFile(m.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		return m.decrypt(m.FilePath, data)
+	}
+	m.cfgMutex.RLock()
+	defer m.cfgMutex.RUnlock()
+	if m.rawBytes == nil {
+		return nil, fmt.Errorf("No config loaded from %s yet", m.FilePath)
+	}
+	return append([]byte(nil), m.rawBytes...), nil
+}
+
+func (m *Manager) setRawBytes(data []byte) {
+	m.cfgMutex.Lock()
+	m.rawBytes = data
+	m.cfgMutex.Unlock()
+}
@@ -0,0 +1,159 @@
+package yamlconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		Validate: func(cfg Config) error {
+			tc := cfg.(*TestCfg)
+			if tc.N != nil && tc.N.S == "invalid" {
+				return fmt.Errorf("Invalid S")
+			}
+			return nil
+		},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "good"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	snapshot, err := m.Snapshot()
+	if err != nil {
+		t.Fatalf("Unable to snapshot: %s", err)
+	}
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "risky"
+		cfg.(*TestCfg).N.I = 1
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+
+	ch, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	if !assert.NoError(t, m.Restore(snapshot), "Restoring snapshot should succeed") {
+		return
+	}
+	expected := &TestCfg{
+		Version: 4,
+		N: &Nested{
+			S: "good",
+			I: FIXED_I,
+		},
+	}
+	assert.Equal(t, expected, m.getCfg(), "Restored config should be current with new version")
+	assert.Equal(t, expected, <-ch, "Restored config should be published")
+	assertSavedConfigEquals(t, file, expected)
+
+	assert.NoError(t, m.Restore(snapshot), "Restoring identical snapshot should succeed")
+	assert.Equal(t, 4, m.getCfg().GetVersion(), "Restoring identical snapshot should not bump version")
+
+	assert.Error(t, m.Restore([]byte("n:\n  s: invalid\n")), "Restoring invalid snapshot should fail")
+	assert.Error(t, m.Restore([]byte("not: [valid")), "Restoring malformed snapshot should fail")
+	assert.Equal(t, expected, m.getCfg(), "Failed restores should keep current config")
+}
+
+func TestRawBytes(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: time.Hour,
+	}
+	_, err = m.RawBytes()
+	assert.Error(t, err, "Nothing should be loaded before Init")
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	assertRawBytesMatchFile := func(msg string) {
+		raw, err := m.RawBytes()
+		if !assert.NoError(t, err) {
+			return
+		}
+		onDisk, err := ioutil.ReadFile(file.Name())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, string(onDisk), string(raw), msg)
+	}
+	assertRawBytesMatchFile("Raw bytes should match initially saved file")
+
+	edited := "# Edited by hand\nversion: 1\nn:\n  s: hand edited  # trailing comment\n  i: 55\n"
+	if err := ioutil.WriteFile(file.Name(), []byte(edited), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	if _, err := m.Reload(); err != nil {
+		t.Fatalf("Unable to reload: %s", err)
+	}
+	raw, err := m.RawBytes()
+	if assert.NoError(t, err) {
+		assert.Equal(t, edited, string(raw), "Raw bytes should include comments")
+	}
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "updated"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	assertRawBytesMatchFile("Raw bytes should match saved file after update")
+
+	if err := ioutil.WriteFile(file.Name(), []byte(edited), 0644); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	raw, _ = m.RawBytes()
+	assert.False(t, strings.Contains(string(raw), "hand edited"), "Cached raw bytes should not reflect unloaded edit")
+	m.FreshRawBytes = true
+	raw, err = m.RawBytes()
+	if assert.NoError(t, err) {
+		assert.Equal(t, edited, string(raw), "Fresh raw bytes should be read from disk")
+	}
+}
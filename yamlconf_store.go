@@ -0,0 +1,245 @@
+package yamlconf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileStore abstracts the storage of the config file at FilePath, for example
+// so that tests can keep it in memory (see MemoryFileStore). Implementations
+// must be safe for concurrent use.
+type FileStore interface {
+	// Read reads the config file.
+	Read() ([]byte, error)
+
+	// Write replaces the config file with the given data, creating it if
+	// necessary.
+	Write(data []byte) error
+
+	// Stat describes the config file. If the file doesn't exist, Stat returns
+	// an error for which os.IsNotExist is true.
+	Stat() (os.FileInfo, error)
+}
+
+func (m *Manager) fileStore() FileStore {
+	if m.FileStore != nil {
+		return m.FileStore
+	}
+	return &diskStore{m}
+}
+
+// diskStore is the default FileStore, which stores the config file on disk.
+type diskStore struct {
+	m *Manager
+}
+
+func (s *diskStore) Read() ([]byte, error) {
+	return s.m.readPath(s.m.FilePath)
+}
+
+func (s *diskStore) Write(data []byte) error {
+	m := s.m
+	path := m.FilePath
+	if m.FollowSymlinks {
+		var err error
+		path, err = filepath.EvalSymlinks(m.FilePath)
+		if err != nil {
+			return fmt.Errorf("Unable to resolve symlinks in %s: %s", m.FilePath, err)
+		}
+	}
+	// Write to a temp file and rename it into place so that a crash mid-write
+	// can't leave a truncated config behind
+	tmpPath := path + ".tmp"
+	if m.StagingPath != "" {
+		tmpPath = m.StagingPath
+	} else if m.TempDir != "" {
+		tmpPath = filepath.Join(m.TempDir, filepath.Base(path)+".tmp")
+	}
+	err := m.writeFile(tmpPath, data)
+	if err != nil {
+		return fmt.Errorf("Unable to write config to file %s: %s", tmpPath, err)
+	}
+	// WriteFile only applies the mode to new files and is subject to umask
+	err = os.Chmod(tmpPath, m.FileMode)
+	if err != nil {
+		return fmt.Errorf("Unable to set mode of %s: %s", tmpPath, err)
+	}
+	if m.StagingPath != "" {
+		if err := m.checkStaged(); err != nil {
+			return fmt.Errorf("Staged config at %s is invalid, not promoting it to %s: %s", tmpPath, path, err)
+		}
+	}
+	err = rename(tmpPath, path)
+	if errors.Is(err, syscall.EXDEV) {
+		m.logger().Debugf("%s is on a different filesystem than %s, copying it over instead", tmpPath, path)
+		err = m.copyAcross(tmpPath, path)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to move %s to %s: %s", tmpPath, path, err)
+	}
+	if m.Fsync {
+		// Make the rename itself durable
+		if err := m.syncDir(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("Unable to sync directory of %s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+var (
+	// rename is os.Rename, replaceable in tests
+	rename = os.Rename
+
+	// syncFile syncs the given file to disk, replaceable in tests
+	syncFile = func(file *os.File) error {
+		return file.Sync()
+	}
+)
+
+// writeFile writes data to the file at path, syncing it to disk if Fsync is
+// set.
+func (m *Manager) writeFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, m.FileMode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && m.Fsync {
+		err = syncFile(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir syncs the directory at path to disk.
+func (m *Manager) syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return syncFile(dir)
+}
+
+// copyAcross moves the file at from to path on a different filesystem by
+// copying it to a temp file next to path and renaming that into place.
+func (m *Manager) copyAcross(from string, path string) error {
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, m.FileMode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = syncFile(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, m.FileMode)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Remove(from); err != nil {
+		m.logger().Debugf("Unable to remove %s: %s", from, err)
+	}
+	return nil
+}
+
+// checkStaged re-reads the config written to StagingPath and validates it.
+func (m *Manager) checkStaged() error {
+	data, err := ioutil.ReadFile(m.StagingPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read staged config: %s", err)
+	}
+	data, err = m.decrypt(m.StagingPath, data)
+	if err != nil {
+		return err
+	}
+	cfg, err := m.newConfig()
+	if err != nil {
+		return err
+	}
+	if err := m.unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("Unable to unmarshal staged config: %s", err)
+	}
+	return m.validate(cfg)
+}
+
+func (s *diskStore) Stat() (os.FileInfo, error) {
+	return os.Stat(s.m.FilePath)
+}
+
+// MemoryFileStore is a FileStore that keeps the config file in memory, which
+// is useful for testing. The zero value is an empty store in which the file
+// doesn't exist yet.
+type MemoryFileStore struct {
+	mx      sync.Mutex
+	data    []byte
+	exists  bool
+	modTime time.Time
+}
+
+// Read implements FileStore.
+func (s *MemoryFileStore) Read() ([]byte, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if !s.exists {
+		return nil, s.notExist("read")
+	}
+	return append([]byte(nil), s.data...), nil
+}
+
+// Write implements FileStore.
+func (s *MemoryFileStore) Write(data []byte) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.data = append([]byte(nil), data...)
+	s.exists = true
+	s.modTime = time.Now()
+	return nil
+}
+
+// Stat implements FileStore.
+func (s *MemoryFileStore) Stat() (os.FileInfo, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if !s.exists {
+		return nil, s.notExist("stat")
+	}
+	return &memoryFileInfo{size: int64(len(s.data)), modTime: s.modTime}, nil
+}
+
+func (s *MemoryFileStore) notExist(op string) error {
+	return &os.PathError{Op: op, Path: "memory", Err: os.ErrNotExist}
+}
+
+type memoryFileInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (fi *memoryFileInfo) Name() string       { return "memory" }
+func (fi *memoryFileInfo) Size() int64        { return fi.size }
+func (fi *memoryFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *memoryFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memoryFileInfo) IsDir() bool        { return false }
+func (fi *memoryFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,75 @@
+package yamlconf
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/yaml"
+)
+
+func TestMemoryFileStore(t *testing.T) {
+	store := &MemoryFileStore{}
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         "memory.yaml",
+		FileStore:        store,
+		FilePollInterval: pollInterval,
+	}
+	_, created, err := m.InitWithStatus()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.True(t, created, "Config should have been created in store")
+	_, err = os.Stat("memory.yaml")
+	assert.True(t, os.IsNotExist(err), "Nothing should be written to disk")
+
+	readStore := func() *TestCfg {
+		data, err := store.Read()
+		if err != nil {
+			t.Fatalf("Unable to read store: %s", err)
+		}
+		cfg := &TestCfg{}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			t.Fatalf("Unable to unmarshal stored config: %s", err)
+		}
+		return cfg
+	}
+	assert.Equal(t, m.getCfg(), readStore(), "Initial config should be saved to store")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "updated"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	assert.Equal(t, "updated", readStore().N.S, "Update should be saved to store")
+
+	edited, err := yaml.Marshal(&TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "edited",
+			I: FIXED_I,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to marshal config: %s", err)
+	}
+	ch, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	<-ch // current config
+	if err := store.Write(edited); err != nil {
+		t.Fatalf("Unable to write to store: %s", err)
+	}
+	select {
+	case updated := <-ch:
+		assert.Equal(t, "edited", updated.(*TestCfg).N.S, "Edit in store should be picked up")
+	case <-time.After(pollInterval * 20):
+		t.Fatal("Edit in store wasn't picked up")
+	}
+}
@@ -0,0 +1,150 @@
+package yamlconf
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/getlantern/yaml"
+)
+
+// checkStrict returns an error naming the first key in the given config file
+// contents that doesn't correspond to any field of cfg or that is duplicated.
+// It does nothing unless Strict is set, or if using a custom Unmarshal.
+func (m *Manager) checkStrict(bytes []byte, cfg Config) error {
+	if !m.Strict || m.Unmarshal != nil {
+		return nil
+	}
+	// JSON is a subset of YAML, so both formats can be parsed as YAML
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(bytes, &doc); err != nil {
+		// Leave reporting malformed documents to unmarshal
+		return nil
+	}
+	tagName := "yaml"
+	if m.Format == FormatJSON {
+		tagName = "json"
+	}
+	return checkKeys("", doc, reflect.TypeOf(cfg), tagName)
+}
+
+func checkKeys(path string, value interface{}, t reflect.Type, tagName string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		doc, ok := value.(yaml.MapSlice)
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		collectFields(t, tagName, fields)
+		return checkMapKeys(path, doc, func(key interface{}) (string, reflect.Type, bool) {
+			for _, name := range keyNames(key) {
+				if tagName == "json" {
+					// encoding/json matches keys case insensitively
+					name = strings.ToLower(name)
+				}
+				if fieldType, found := fields[name]; found {
+					return name, fieldType, true
+				}
+			}
+			return fmt.Sprint(key), nil, false
+		}, tagName)
+	case reflect.Map:
+		doc, ok := value.(yaml.MapSlice)
+		if !ok {
+			return nil
+		}
+		return checkMapKeys(path, doc, func(key interface{}) (string, reflect.Type, bool) {
+			return fmt.Sprint(key), t.Elem(), true
+		}, tagName)
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			if err := checkKeys(joinPath(path, fmt.Sprint(i)), item, t.Elem(), tagName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkMapKeys(path string, doc yaml.MapSlice, lookup func(key interface{}) (string, reflect.Type, bool), tagName string) error {
+	seen := make(map[string]bool, len(doc))
+	for _, item := range doc {
+		key, fieldType, found := lookup(item.Key)
+		keyPath := joinPath(path, key)
+		if seen[key] {
+			return fmt.Errorf("Duplicate key %s", keyPath)
+		}
+		seen[key] = true
+		if !found {
+			return fmt.Errorf("Unknown key %s", keyPath)
+		}
+		if err := checkKeys(keyPath, item.Value, fieldType, tagName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyNames returns the names that may have been parsed as the given key. YAML
+// parses keys like "n" or "on" as booleans, whereas they're matched to struct
+// fields by name.
+func keyNames(key interface{}) []string {
+	switch key {
+	case true:
+		return []string{"y", "Y", "yes", "Yes", "YES", "on", "On", "ON", "true", "True", "TRUE"}
+	case false:
+		return []string{"n", "N", "no", "No", "NO", "off", "Off", "OFF", "false", "False", "FALSE"}
+	default:
+		return []string{fmt.Sprint(key)}
+	}
+}
+
+// collectFields collects the types of the fields of struct type t by the keys
+// under which they're serialized, including fields of inlined structs.
+func collectFields(t reflect.Type, tagName string, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			// Unexported
+			continue
+		}
+		tag := strings.Split(field.Tag.Get(tagName), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		inline := false
+		for _, flag := range tag[1:] {
+			inline = inline || flag == "inline"
+		}
+		if tagName == "json" && field.Anonymous && name == "" {
+			inline = true
+		}
+		if inline {
+			fieldType := field.Type
+			for fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct {
+				collectFields(fieldType, tagName, fields)
+			}
+			continue
+		}
+		if name == "" {
+			// yaml defaults to the lowercased field name
+			name = strings.ToLower(field.Name)
+		}
+		if tagName == "json" {
+			name = strings.ToLower(name)
+		}
+		fields[name] = field.Type
+	}
+}
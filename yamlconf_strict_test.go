@@ -0,0 +1,116 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/yaml"
+)
+
+func TestStrict(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	write := func(content string) {
+		if err := ioutil.WriteFile(file.Name(), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write config: %s", err)
+		}
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		Strict:   true,
+	}
+	write("version: 1\nn:\n  s: good\n")
+	if err := m.loadFromDisk(); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+
+	write("version: 1\nn:\n  s: typo\n  ii: 5\n")
+	_, err = m.reloadFromDisk()
+	if assert.Error(t, err, "Unknown key should be rejected") {
+		assert.Contains(t, err.Error(), "Unknown key n.ii")
+	}
+	write("version: 1\nversion: 2\n")
+	_, err = m.reloadFromDisk()
+	if assert.Error(t, err, "Duplicate key should be rejected") {
+		assert.Contains(t, err.Error(), "Duplicate key version")
+	}
+	assert.Equal(t, "good", m.getCfg().(*TestCfg).N.S, "Last good config should be kept")
+
+	source := &memorySource{}
+	source.set("n:\n  x: remote\n")
+	m.RemoteSource = source
+	_, err = m.fetchRemoteConfig()
+	if assert.Error(t, err, "Unknown key from remote should be rejected") {
+		assert.Contains(t, err.Error(), "Unknown key n.x")
+	}
+
+	m.Strict = false
+	write("version: 1\nn:\n  s: lenient\n  ii: 5\n")
+	_, err = m.reloadFromDisk()
+	assert.NoError(t, err, "Unknown key should be ignored when not strict")
+	assert.Equal(t, "lenient", m.getCfg().(*TestCfg).N.S)
+}
+
+type strictCfg struct {
+	Tagged  string              `yaml:"custom" json:"custom"`
+	Skipped string              `yaml:"-" json:"-"`
+	Inline  strictInline        `yaml:",inline"`
+	Items   []*Nested           `yaml:"items"`
+	ByName  map[string]*Nested  `yaml:"byname"`
+	Any     interface{}         `yaml:"any"`
+	Nested  map[string][]string `yaml:"nested"`
+}
+
+type strictInline struct {
+	Inlined string
+}
+
+func TestCheckKeys(t *testing.T) {
+	check := func(doc string) error {
+		var parsed yaml.MapSlice
+		if err := yaml.Unmarshal([]byte(doc), &parsed); err != nil {
+			t.Fatalf("Unable to parse %s: %s", doc, err)
+		}
+		return checkKeys("", parsed, reflect.TypeOf(&strictCfg{}), "yaml")
+	}
+
+	checkErr := func(doc string) string {
+		if err := check(doc); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+
+	assert.NoError(t, check(`
+custom: a
+inlined: b
+items:
+  - s: c
+byname:
+  x:
+    i: 1
+any:
+  whatever: true
+nested:
+  k: [a, b]
+`))
+	assert.Equal(t, "Unknown key tagged", checkErr("tagged: a\n"))
+	assert.Equal(t, "Unknown key skipped", checkErr("skipped: a\n"))
+	assert.Equal(t, "Unknown key items.1.bad", checkErr("items:\n  - s: a\n  - bad: b\n"))
+	assert.Equal(t, "Unknown key byname.x.bad", checkErr("byname:\n  x:\n    bad: 1\n"))
+	assert.Equal(t, "Duplicate key byname.x", checkErr("byname:\n  x: {}\n  x: {}\n"))
+}
@@ -0,0 +1,298 @@
+package yamlconf
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Subscribe registers a new subscriber to config changes, returning a channel
+// on which changed configs are delivered along with a function for
+// unsubscribing. Each subscriber receives every published config independently
+// of other subscribers. The current config is delivered right away, so that
+// subscribers don't have to wait for the next change to learn about it.
+//
+// Delivery never blocks the Manager. Each subscriber channel buffers a single
+// config; if a subscriber falls behind, the pending config is dropped in favor
+// of the newer one, so slow subscribers may miss intermediate configs but will
+// always see the latest. The channel is closed on unsubscribe or when the
+// Manager is stopped.
+func (m *Manager) Subscribe() (<-chan Config, func()) {
+	ch := make(chan Config, 1)
+
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	if m.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	if m.subscribers == nil {
+		m.subscribers = make(map[int]chan Config)
+	}
+	id := m.nextSubscriberID
+	m.nextSubscriberID++
+	m.subscribers[id] = ch
+	if cfg := m.getCfg(); cfg != nil {
+		ch <- cfg
+	}
+
+	return ch, func() {
+		m.subscribersMutex.Lock()
+		defer m.subscribersMutex.Unlock()
+		if _, found := m.subscribers[id]; found {
+			delete(m.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// fieldSubscription is a subscription to changes of the field at path.
+type fieldSubscription struct {
+	path string
+	ch   chan interface{}
+}
+
+// SubscribeField is like Subscribe, but only delivers the value of the field at
+// the given dotted path (e.g. "N.I") and only when that value changes. Pointers
+// along the path are dereferenced; if one of them is nil, the value is nil.
+// Values are shared with the Manager's config and must not be modified.
+func (m *Manager) SubscribeField(path string) (<-chan interface{}, func()) {
+	ch := make(chan interface{}, 1)
+
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	if m.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	if m.fieldSubscribers == nil {
+		m.fieldSubscribers = make(map[int]*fieldSubscription)
+	}
+	id := m.nextSubscriberID
+	m.nextSubscriberID++
+	m.fieldSubscribers[id] = &fieldSubscription{path, ch}
+	if cfg := m.getCfg(); cfg != nil {
+		ch <- valueAt(cfg, path)
+	}
+
+	return ch, func() {
+		m.subscribersMutex.Lock()
+		defer m.subscribersMutex.Unlock()
+		if _, found := m.fieldSubscribers[id]; found {
+			delete(m.fieldSubscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// ackSubscription is a subscription whose subscriber acknowledges the configs
+// it has processed. All fields are guarded by subscribersMutex.
+type ackSubscription struct {
+	ch chan Config
+	// sent is the version of the config last sent on ch
+	sent int
+	// received is the version of the config last taken from ch, or -1
+	received int
+	// acked is the version last acknowledged, or -1
+	acked int
+}
+
+// SubscribeAck is like Subscribe, but the subscriber acknowledges each config
+// it has finished processing by calling ack, which lets WaitForAck block until
+// a change has been processed everywhere. ack acknowledges the config most
+// recently received from the channel. Subscribers that go away must call
+// unsubscribe, otherwise WaitForAck waits for them until it times out.
+func (m *Manager) SubscribeAck() (<-chan Config, func(), func()) {
+	ch := make(chan Config, 1)
+
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	if m.stopped {
+		close(ch)
+		return ch, func() {}, func() {}
+	}
+	if m.ackSubscribers == nil {
+		m.ackSubscribers = make(map[int]*ackSubscription)
+	}
+	id := m.nextSubscriberID
+	m.nextSubscriberID++
+	sub := &ackSubscription{ch: ch, sent: -1, received: -1, acked: -1}
+	m.ackSubscribers[id] = sub
+	if cfg := m.getCfg(); cfg != nil {
+		ch <- cfg
+		sub.sent = cfg.GetVersion()
+	}
+
+	ack := func() {
+		m.subscribersMutex.Lock()
+		defer m.subscribersMutex.Unlock()
+		if len(ch) == 0 {
+			// Nothing pending, so the last config sent has been received
+			sub.received = sub.sent
+		}
+		if sub.received > sub.acked {
+			sub.acked = sub.received
+			m.notifyAcksChanged()
+		}
+	}
+	unsubscribe := func() {
+		m.subscribersMutex.Lock()
+		defer m.subscribersMutex.Unlock()
+		if _, found := m.ackSubscribers[id]; found {
+			delete(m.ackSubscribers, id)
+			close(ch)
+			m.notifyAcksChanged()
+		}
+	}
+	return ch, ack, unsubscribe
+}
+
+// WaitForVersion blocks until the config's version is at least the given
+// version, returning a copy of that config. It fails if ctx is done or the
+// Manager is stopped first.
+func (m *Manager) WaitForVersion(ctx context.Context, version int) (Config, error) {
+	// Subscribe before checking the current version so that no change is missed
+	ch, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	for {
+		if cfg := m.getCfg(); cfg != nil && cfg.GetVersion() >= version {
+			return m.copy(cfg)
+		}
+		select {
+		case _, open := <-ch:
+			if !open {
+				return nil, errStopped
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// WaitForAck blocks until every subscriber registered with SubscribeAck has
+// acknowledged a config whose version is at least the given version. Waiting
+// fails if that doesn't happen within timeout or if the Manager is stopped
+// first. Subscribers that unsubscribe while waiting are no longer waited for.
+func (m *Manager) WaitForAck(version int, timeout time.Duration) error {
+	timedOut := m.getClock().After(timeout)
+	for {
+		m.subscribersMutex.Lock()
+		if m.stopped {
+			m.subscribersMutex.Unlock()
+			return errStopped
+		}
+		pending := 0
+		for _, sub := range m.ackSubscribers {
+			if sub.acked < version {
+				pending++
+			}
+		}
+		if pending == 0 {
+			m.subscribersMutex.Unlock()
+			return nil
+		}
+		if m.acksChanged == nil {
+			m.acksChanged = make(chan struct{})
+		}
+		changed := m.acksChanged
+		m.subscribersMutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-timedOut:
+			return fmt.Errorf("Timed out waiting for %d subscriber(s) to acknowledge version %d", pending, version)
+		}
+	}
+}
+
+// notifyAcksChanged wakes up everyone in WaitForAck. subscribersMutex must be
+// held.
+func (m *Manager) notifyAcksChanged() {
+	if m.acksChanged != nil {
+		close(m.acksChanged)
+		m.acksChanged = nil
+	}
+}
+
+// publish fans out the current config to all subscribers.
+func (m *Manager) publish() {
+	m.logger().Trace("Publish changed config")
+	cfg := m.cfg
+
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	for _, ch := range m.subscribers {
+		select {
+		case ch <- cfg:
+		default:
+			// Drop the pending config in favor of the latest one
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- cfg
+		}
+	}
+	for _, sub := range m.ackSubscribers {
+		select {
+		case sub.ch <- cfg:
+			// The buffer was empty, so the config sent before was received
+			sub.received = sub.sent
+		default:
+			// Drop the pending config in favor of the latest one
+			select {
+			case <-sub.ch:
+			default:
+				sub.received = sub.sent
+			}
+			sub.ch <- cfg
+		}
+		sub.sent = cfg.GetVersion()
+	}
+}
+
+// publishFields delivers the values of changed fields to field subscribers.
+func (m *Manager) publishFields(previous Config) {
+	cfg := m.cfg
+
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	for _, sub := range m.fieldSubscribers {
+		value := valueAt(cfg, sub.path)
+		if previous != nil && reflect.DeepEqual(valueAt(previous, sub.path), value) {
+			continue
+		}
+		select {
+		case sub.ch <- value:
+		default:
+			// Drop the pending value in favor of the latest one
+			select {
+			case <-sub.ch:
+			default:
+			}
+			sub.ch <- value
+		}
+	}
+}
+
+// closeSubscribers closes all subscriber channels and prevents new
+// subscriptions.
+func (m *Manager) closeSubscribers() {
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	m.stopped = true
+	for id, ch := range m.subscribers {
+		delete(m.subscribers, id)
+		close(ch)
+	}
+	for id, sub := range m.fieldSubscribers {
+		delete(m.fieldSubscribers, id)
+		close(sub.ch)
+	}
+	for id, sub := range m.ackSubscribers {
+		delete(m.ackSubscribers, id)
+		close(sub.ch)
+	}
+	m.notifyAcksChanged()
+}
@@ -0,0 +1,425 @@
+package yamlconf
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	var subs []<-chan Config
+	for i := 0; i < 3; i++ {
+		ch, unsubscribe := m.Subscribe()
+		defer unsubscribe()
+		subs = append(subs, ch)
+	}
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "subscribed"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+
+	expected := &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "subscribed",
+			I: FIXED_I,
+		},
+	}
+	for i, ch := range subs {
+		assert.Equal(t, expected, <-ch, "Subscriber %d should receive update", i)
+	}
+
+	ch, unsubscribe := m.Subscribe()
+	unsubscribe()
+	<-ch // current config
+	_, open := <-ch
+	assert.False(t, open, "Unsubscribing should close channel")
+}
+
+func TestWaitForVersion(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+
+	go func() {
+		m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = "waited for"
+			return nil
+		})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cfg, err := m.WaitForVersion(ctx, 2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, cfg.GetVersion())
+		assert.Equal(t, "waited for", cfg.(*TestCfg).N.S)
+	}
+
+	cfg, err = m.WaitForVersion(ctx, 1)
+	if assert.NoError(t, err, "Already reached version should return immediately") {
+		assert.Equal(t, 2, cfg.GetVersion())
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	_, err = m.WaitForVersion(shortCtx, 10)
+	assert.Equal(t, context.DeadlineExceeded, err, "Waiting should honor context")
+
+	m.Stop()
+	_, err = m.WaitForVersion(ctx, 10)
+	assert.Equal(t, errStopped, err, "Waiting on stopped manager should fail")
+}
+
+func TestUpdateWithoutReadingNext(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 10; i++ {
+			i := i
+			err := m.Update(func(cfg Config) error {
+				cfg.(*TestCfg).N.I = i
+				return nil
+			})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Updates should not block when nobody reads Next()")
+	}
+	assert.Equal(t, 9, m.Next().(*TestCfg).N.I, "Next should return latest config")
+}
+
+func TestSubscribeReceivesCurrentConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "before subscribing"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+
+	ch, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	select {
+	case cfg := <-ch:
+		assert.Equal(t, m.getCfg(), cfg, "Late subscriber should receive current config")
+	default:
+		t.Fatal("Late subscriber should receive current config immediately")
+	}
+	select {
+	case cfg := <-ch:
+		t.Fatalf("Current config should only be delivered once, also got %v", cfg)
+	default:
+	}
+}
+
+func TestSubscribeField(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	ch, unsubscribe := m.SubscribeField("N.I")
+	defer unsubscribe()
+	assert.Equal(t, FIXED_I, <-ch, "Current value should be delivered right away")
+
+	update := func(mutate func(cfg *TestCfg)) {
+		err := m.Update(func(cfg Config) error {
+			mutate(cfg.(*TestCfg))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+	}
+	update(func(cfg *TestCfg) { cfg.N.S = "unrelated" })
+	select {
+	case value := <-ch:
+		t.Fatalf("Change to other field should not be delivered, got %v", value)
+	default:
+	}
+
+	update(func(cfg *TestCfg) { cfg.N.I = 77 })
+	select {
+	case value := <-ch:
+		assert.Equal(t, 77, value, "Change to field should be delivered")
+	default:
+		t.Fatal("Change to field should be delivered")
+	}
+
+	// Defaults replace the nil N
+	update(func(cfg *TestCfg) { cfg.N = nil })
+	select {
+	case value := <-ch:
+		assert.Equal(t, FIXED_I, value, "Replacing parent should be delivered as change")
+	default:
+		t.Fatal("Replacing parent should be delivered as change")
+	}
+	assert.Nil(t, valueAt(&TestCfg{}, "N.I"), "Field behind nil pointer should be nil")
+
+	parent, unsubscribeParent := m.SubscribeField("N")
+	defer unsubscribeParent()
+	<-parent // current value
+	update(func(cfg *TestCfg) { cfg.N = &Nested{S: "nested", I: 77} })
+	select {
+	case value := <-parent:
+		assert.Equal(t, Nested{S: "nested", I: 77}, value, "Pointer should be dereferenced")
+	default:
+		t.Fatal("Change within struct should be delivered")
+	}
+	assert.Equal(t, 77, <-ch)
+
+	m.Stop()
+	_, open := <-ch
+	assert.False(t, open, "Channel should be closed when stopped")
+}
+
+func TestRepublish(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	current, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	ch, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	<-ch // current config
+	before, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+
+	assert.NoError(t, m.Republish())
+	assert.Equal(t, current, m.Next(), "Next should fire after republishing")
+	select {
+	case cfg := <-ch:
+		assert.Equal(t, current, cfg, "Subscriber should receive republished config")
+	default:
+		t.Fatal("Subscriber should receive republished config")
+	}
+	assert.Equal(t, 1, m.getCfg().GetVersion(), "Republishing should not change version")
+	after, err := ioutil.ReadFile(file.Name())
+	if assert.NoError(t, err) {
+		assert.Equal(t, string(before), string(after), "Republishing should not write to disk")
+	}
+
+	m.Stop()
+	assert.Equal(t, errStopped, m.Republish(), "Republishing on stopped manager should fail")
+}
+
+func TestWaitForAck(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+
+	assert.NoError(t, m.WaitForAck(10, 0), "Without ack subscribers, there should be nothing to wait for")
+
+	ch1, ack1, unsubscribe1 := m.SubscribeAck()
+	ch2, ack2, unsubscribe2 := m.SubscribeAck()
+	defer unsubscribe2()
+	assert.Equal(t, 1, (<-ch1).GetVersion())
+	assert.Equal(t, 1, (<-ch2).GetVersion())
+	ack1()
+	ack2()
+	assert.NoError(t, m.WaitForAck(1, 50*time.Millisecond), "Current config should be acknowledged")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "acked"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	err = m.WaitForAck(2, 50*time.Millisecond)
+	if assert.Error(t, err, "Waiting for unacknowledged version should time out") {
+		assert.Contains(t, err.Error(), "2 subscriber(s)")
+	}
+
+	ack1()
+	err = m.WaitForAck(2, 50*time.Millisecond)
+	assert.Error(t, err, "Acknowledging without receiving the new config should not count")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.WaitForAck(2, 5*time.Second)
+	}()
+	for i, sub := range []struct {
+		ch  <-chan Config
+		ack func()
+	}{{ch1, ack1}, {ch2, ack2}} {
+		cfg := <-sub.ch
+		assert.Equal(t, "acked", cfg.(*TestCfg).N.S, "Subscriber %d should receive update", i)
+		sub.ack()
+	}
+	assert.NoError(t, <-done, "Waiting should finish once both subscribers acknowledged")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "unsubscribed"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	go func() {
+		done <- m.WaitForAck(3, 5*time.Second)
+	}()
+	<-ch2
+	ack2()
+	unsubscribe1()
+	assert.NoError(t, <-done, "Unsubscribed subscriber should no longer be waited for")
+
+	go func() {
+		done <- m.WaitForAck(10, 5*time.Second)
+	}()
+	m.Stop()
+	assert.Equal(t, errStopped, <-done, "Waiting on stopped manager should fail")
+	_, ok := <-ch2
+	assert.False(t, ok, "Stopping should close ack subscriber channel")
+}
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/getlantern/golog"
 	"github.com/getlantern/testify/assert"
 	"github.com/getlantern/yaml"
 )
@@ -63,7 +67,8 @@ func TestFileAndUpdate(t *testing.T) {
 		EmptyConfig: func() Config {
 			return &TestCfg{}
 		},
-		FilePath: file.Name(),
+		FilePath:         file.Name(),
+		FilePollInterval: pollInterval,
 	}
 
 	first, err := m.Init()
@@ -189,6 +194,309 @@ func TestCustomPoll(t *testing.T) {
 	}, updated, "Custom polled config should contain correct data")
 }
 
+func TestStop(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+
+	m.Stop()
+	m.Stop()
+	assert.Nil(t, m.Next(), "Next should return nil once stopped")
+	err = m.Update(func(cfg Config) error {
+		return nil
+	})
+	assert.Error(t, err, "Update should fail once stopped")
+}
+
+func TestValidate(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: pollInterval,
+		Validate: func(cfg Config) error {
+			tc := cfg.(*TestCfg)
+			if tc.N != nil && tc.N.I < 0 {
+				return fmt.Errorf("I must not be negative")
+			}
+			return nil
+		},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	expected := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			I: FIXED_I,
+		},
+	}
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.I = -1
+		return nil
+	})
+	assert.Error(t, err, "Invalid programmatic update should be rejected")
+	assert.Equal(t, expected, m.getCfg(), "Config should be unchanged after rejected update")
+	assertSavedConfigEquals(t, file, expected)
+
+	saveConfig(t, file, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			I: -5,
+		},
+	})
+	time.Sleep(pollInterval * 2)
+	assert.Equal(t, expected, m.getCfg(), "Invalid config on disk should be ignored")
+}
+
+func TestCurrent(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			i := i
+			err := m.Update(func(cfg Config) error {
+				cfg.(*TestCfg).N.I = i + 1
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Unable to update: %s", err)
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		current := m.Current().(*TestCfg)
+		// Mutating the copy must not affect the Manager
+		current.N.S = "mutated"
+	}
+	wg.Wait()
+
+	assert.Equal(t, &TestCfg{
+		Version: 21,
+		N: &Nested{
+			I: 20,
+		},
+	}, m.Current(), "Current should reflect latest update")
+}
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Unable to get working directory: %s", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Unable to change working directory: %s", err)
+	}
+	defer os.Chdir(wd)
+	if err := ioutil.WriteFile("config.yaml", nil, 0644); err != nil {
+		t.Fatalf("Unable to create config file: %s", err)
+	}
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: "config.yaml",
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	expected, err := filepath.Abs("config.yaml")
+	if err != nil {
+		t.Fatalf("Unable to resolve path: %s", err)
+	}
+	assert.Equal(t, expected, m.ConfigFile(), "ConfigFile should be absolute")
+	assert.Equal(t, "disk", m.LastLoadedFrom(), "Initial config should come from disk")
+}
+
+func TestOnChange(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	var mx sync.Mutex
+	var changes [][2]string
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		OnChange: func(old, new Config) {
+			mx.Lock()
+			defer mx.Unlock()
+			changes = append(changes, [2]string{old.(*TestCfg).N.S, new.(*TestCfg).N.S})
+		},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	for _, s := range []string{"a", "a", "b"} {
+		s := s
+		err := m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = s
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, [][2]string{{"", "a"}, {"a", "b"}}, changes, "OnChange should only be called for actual changes")
+}
+
+func TestDryRunUpdate(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		Validate: func(cfg Config) error {
+			if tc := cfg.(*TestCfg); tc.N != nil && tc.N.I < 0 {
+				return fmt.Errorf("I must not be negative")
+			}
+			return nil
+		},
+		ImmutableFields: []string{"N.I"},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	current := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			I: FIXED_I,
+		},
+	}
+
+	preview, err := m.DryRunUpdate(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "preview"
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "preview",
+			I: FIXED_I,
+		},
+	}, preview, "Dry run should return would-be config")
+
+	preview, err = m.DryRunUpdate(func(cfg Config) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, current, preview, "No-op dry run should not bump version")
+
+	_, err = m.DryRunUpdate(func(cfg Config) error {
+		cfg.(*TestCfg).N.I = -1
+		return nil
+	})
+	assert.Error(t, err, "Dry run should validate")
+
+	_, err = m.DryRunUpdate(func(cfg Config) error {
+		cfg.(*TestCfg).N.I = FIXED_I + 1
+		return nil
+	})
+	assert.Error(t, err, "Dry run should check immutable fields")
+
+	_, err = m.DryRunUpdate(func(cfg Config) error {
+		panic("I don't wanna preview")
+	})
+	assert.Error(t, err, "Dry run should recover from panicking mutator")
+
+	assert.Equal(t, current, m.Current(), "Dry run should not change current config")
+	assertSavedConfigEquals(t, file, current)
+}
+
 func assertSavedConfigEquals(t *testing.T, file *os.File, expected *TestCfg) {
 	b, err := yaml.Marshal(expected)
 	if err != nil {
@@ -213,3 +521,811 @@ func saveConfig(t *testing.T, file *os.File, updated *TestCfg) {
 		t.Fatalf("Unable to save test config: %s", err)
 	}
 }
+
+func TestNilEmptyConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return nil
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	assert.Error(t, err, "Init should fail if EmptyConfig returns nil")
+
+	_, err = m.copy(&TestCfg{})
+	assert.Equal(t, errNilConfig, err, "Copying should fail if EmptyConfig returns nil")
+
+	_, err = m.saveToDiskAndUpdate(nil)
+	assert.Equal(t, errNilConfig, err, "Saving nil config should fail")
+}
+
+func TestPanickingUpdate(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	err = m.Update(func(cfg Config) error {
+		var n *Nested
+		n.S = "boom"
+		return nil
+	})
+	assert.Error(t, err, "Panicking update should fail")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "recovered"
+		return nil
+	})
+	assert.NoError(t, err, "Manager should keep processing updates after a panic")
+	assert.Equal(t, "recovered", m.getCfg().(*TestCfg).N.S)
+}
+
+func TestUpdateAfterEditOnDisk(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+		// Make sure that polling doesn't pick up the edit first
+		FilePollInterval: 1 * time.Hour,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	saveConfig(t, file, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "edited on disk",
+			I: FIXED_I,
+		},
+	})
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.I = 77
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+
+	expected := &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "edited on disk",
+			I: 77,
+		},
+	}
+	assert.Equal(t, expected, m.getCfg(), "Both the edit on disk and the update should be applied")
+	assertSavedConfigEquals(t, file, expected)
+}
+
+func TestInitWithStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	newManager := func() *Manager {
+		return &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath: path,
+		}
+	}
+	expected := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			I: FIXED_I,
+		},
+	}
+
+	m := newManager()
+	cfg, created, err := m.InitWithStatus()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	m.Stop()
+	assert.True(t, created, "Missing file should be reported as created")
+	assert.Equal(t, expected, cfg, "Created config should have defaults")
+	bod, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	loaded := &TestCfg{}
+	if err := yaml.Unmarshal(bod, loaded); err != nil {
+		t.Fatalf("Unable to unmarshal config: %s", err)
+	}
+	assert.Equal(t, expected, loaded, "Created config should be saved")
+
+	m = newManager()
+	cfg, created, err = m.InitWithStatus()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	m.Stop()
+	assert.False(t, created, "Existing file should be reported as loaded")
+	assert.Equal(t, expected, cfg, "Existing config should be loaded")
+}
+
+func TestLoadedAtAndLastModified(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	initiallyLoadedAt := m.LoadedAt()
+	assert.False(t, initiallyLoadedAt.IsZero(), "LoadedAt should be set after Init")
+	fileInfo, err := os.Stat(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to stat file: %s", err)
+	}
+	assert.Equal(t, fileInfo.ModTime(), m.LastModified(), "LastModified should match file on disk")
+
+	time.Sleep(10 * time.Millisecond)
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "later"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	assert.True(t, m.LoadedAt().After(initiallyLoadedAt), "LoadedAt should advance after update")
+	fileInfo, err = os.Stat(file.Name())
+	if err != nil {
+		t.Fatalf("Unable to stat file: %s", err)
+	}
+	assert.Equal(t, fileInfo.ModTime(), m.LastModified(), "LastModified should match saved file")
+}
+
+func TestUnmanagedVersion(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+	saveConfig(t, file, &TestCfg{
+		Version: 7,
+		N: &Nested{
+			I: FIXED_I,
+		},
+	})
+
+	for _, unmanaged := range []bool{false, true} {
+		m := &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath:         file.Name(),
+			FilePollInterval: 1 * time.Hour,
+			UnmanagedVersion: unmanaged,
+		}
+		_, err = m.Init()
+		if err != nil {
+			t.Fatalf("Unable to init manager: %s", err)
+		}
+		startVersion := m.getCfg().GetVersion()
+
+		err = m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = fmt.Sprint("unmanaged ", unmanaged)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+		if unmanaged {
+			assert.Equal(t, startVersion, m.getCfg().GetVersion(), "Unmanaged version should not be incremented")
+
+			err = m.Update(func(cfg Config) error {
+				cfg.SetVersion(3)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Unable to update: %s", err)
+			}
+			assert.Equal(t, 3, m.getCfg().GetVersion(), "Changing only the version should count as a change")
+			assertSavedConfigEquals(t, file, m.getCfg().(*TestCfg))
+
+			saveConfig(t, file, &TestCfg{
+				Version: 1,
+				N: &Nested{
+					S: "older version",
+					I: FIXED_I,
+				},
+			})
+			changed, err := m.Reload()
+			assert.NoError(t, err, "Lower version on disk should be accepted")
+			assert.True(t, changed)
+			assert.Equal(t, 1, m.getCfg().GetVersion())
+		} else {
+			assert.Equal(t, startVersion+1, m.getCfg().GetVersion(), "Managed version should be incremented")
+		}
+		m.Stop()
+	}
+}
+
+func TestSet(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	replacement := &TestCfg{
+		N: &Nested{
+			S: "replaced",
+		},
+	}
+	if err := m.Set(replacement); err != nil {
+		t.Fatalf("Unable to set config: %s", err)
+	}
+	expected := &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "replaced",
+			I: FIXED_I,
+		},
+	}
+	assert.Equal(t, expected, m.Next(), "Replacement should be published with defaults and new version")
+	assertSavedConfigEquals(t, file, expected)
+
+	replacement.N.S = "mutated afterwards"
+	assert.Equal(t, "replaced", m.getCfg().(*TestCfg).N.S, "Mutating the passed config should not affect the Manager")
+
+	if err := m.Set(expected); err != nil {
+		t.Fatalf("Unable to set config: %s", err)
+	}
+	assert.Equal(t, 2, m.getCfg().GetVersion(), "Setting identical config should not bump version")
+}
+
+type mapCfg struct {
+	Version int
+	Items   map[string]int
+}
+
+func (c *mapCfg) GetVersion() int {
+	return c.Version
+}
+
+func (c *mapCfg) SetVersion(version int) {
+	c.Version = version
+}
+
+func (c *mapCfg) ApplyDefaults() {
+}
+
+func TestFingerprint(t *testing.T) {
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &mapCfg{}
+		},
+	}
+	fingerprint := func(cfg Config) string {
+		m.setCfg(cfg)
+		return m.Fingerprint()
+	}
+
+	a := &mapCfg{Version: 1, Items: make(map[string]int)}
+	b := &mapCfg{Version: 2, Items: make(map[string]int)}
+	for i := 0; i < 100; i++ {
+		a.Items[fmt.Sprint(i)] = i
+		b.Items[fmt.Sprint(99-i)] = 99 - i
+	}
+	fa := fingerprint(a)
+	assert.Len(t, fa, 64, "Fingerprint should be hex-encoded SHA256")
+	assert.Equal(t, fa, fingerprint(b), "Configs with same content should have same fingerprint")
+	assert.Equal(t, 1, a.Version, "Fingerprinting should not modify config")
+
+	b.Items["5"] = 6
+	assert.NotEqual(t, fa, fingerprint(b), "Changed config should have different fingerprint")
+}
+
+func TestUpdateAndGet(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	expected := &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "gotten",
+			I: FIXED_I,
+		},
+	}
+	updated, err := m.UpdateAndGet(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "gotten"
+		return nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, updated, "Resulting config should reflect update and bumped version")
+		updated.(*TestCfg).N.S = "mutated"
+		assert.Equal(t, "gotten", m.getCfg().(*TestCfg).N.S, "Returned config should be a copy")
+	}
+
+	updated, err = m.UpdateAndGet(func(cfg Config) error {
+		return nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, updated, "No-op update should return current config")
+	}
+
+	_, err = m.UpdateAndGet(func(cfg Config) error {
+		return fmt.Errorf("Failed")
+	})
+	assert.Error(t, err, "Failed update should return error")
+}
+
+func TestPauseResume(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:         file.Name(),
+		FilePollInterval: pollInterval,
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	m.Pause()
+	assert.True(t, m.IsPaused())
+	saveConfig(t, file, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "edited while paused",
+			I: FIXED_I,
+		},
+	})
+	time.Sleep(pollInterval * 2)
+	assert.Equal(t, "", m.getCfg().(*TestCfg).N.S, "Edit should not be picked up while paused")
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.I = 77
+		return nil
+	})
+	assert.NoError(t, err, "Updates should work while paused")
+	assert.Equal(t, 77, m.getCfg().(*TestCfg).N.I)
+
+	saveConfig(t, file, &TestCfg{
+		Version: 2,
+		N: &Nested{
+			S: "edited while paused",
+			I: 77,
+		},
+	})
+	assert.NoError(t, m.Resume())
+	assert.False(t, m.IsPaused())
+	assert.Equal(t, "edited while paused", m.getCfg().(*TestCfg).N.S, "Edit should be picked up on resume")
+}
+
+func TestResetVersion(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	if err := m.ResetVersion(100); err != nil {
+		t.Fatalf("Unable to reset version: %s", err)
+	}
+	expected := &TestCfg{
+		Version: 100,
+		N: &Nested{
+			I: FIXED_I,
+		},
+	}
+	assert.Equal(t, expected, m.Next(), "Reset version should be published")
+	assertSavedConfigEquals(t, file, expected)
+
+	err = m.Update(func(cfg Config) error {
+		cfg.(*TestCfg).N.S = "after reset"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	assert.Equal(t, 101, m.getCfg().GetVersion(), "Updates should increment from reset version")
+
+	if err := m.ResetVersion(1); err != nil {
+		t.Fatalf("Unable to reset version: %s", err)
+	}
+	assert.Equal(t, 1, m.getCfg().GetVersion(), "Version should be resettable to lower version")
+	time.Sleep(pollInterval * 2)
+	assert.Equal(t, 1, m.getCfg().GetVersion(), "Lower version on disk should not be considered stale")
+
+	assert.Error(t, m.ResetVersion(-1), "Negative version should be rejected")
+}
+
+func TestResetVersionSavesLikeUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	historyDir := filepath.Join(dir, "history")
+	if err := os.Mkdir(historyDir, 0755); err != nil {
+		t.Fatalf("Unable to create history dir: %s", err)
+	}
+
+	var saved []int
+	reject := false
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:   filepath.Join(dir, "config.yaml"),
+		HistoryDir: historyDir,
+		Validate: func(cfg Config) error {
+			if reject {
+				return fmt.Errorf("Rejected")
+			}
+			return nil
+		},
+		BeforeSave: func(cfg Config) error {
+			saved = append(saved, cfg.GetVersion())
+			return nil
+		},
+	}
+	_, err = m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+
+	if err := m.ResetVersion(10); err != nil {
+		t.Fatalf("Unable to reset version: %s", err)
+	}
+	assert.Equal(t, []int{1, 10}, saved, "BeforeSave should be called for reset version")
+	entries, err := m.History()
+	if assert.NoError(t, err) && assert.Len(t, entries, 2) {
+		assert.Equal(t, 10, entries[1].Version, "Reset version should be recorded in history")
+	}
+
+	reject = true
+	assert.Error(t, m.ResetVersion(20), "Reset version should be validated")
+	assert.Equal(t, 10, m.getCfg().GetVersion(), "Invalid reset should not change version")
+}
+
+func TestVersionWrapsAround(t *testing.T) {
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+	}
+	current := &TestCfg{Version: math.MaxInt, N: &Nested{}}
+	updated := &TestCfg{N: &Nested{S: "changed"}}
+	changed, err := m.prepareUpdate(current, updated)
+	if assert.NoError(t, err) && assert.True(t, changed) {
+		assert.Equal(t, 1, updated.GetVersion(), "Version should wrap around")
+	}
+}
+
+// hookCfg has a func field, which deepcopy can't copy since it goes through
+// JSON.
+type hookCfg struct {
+	Version int
+	Items   map[string]int
+	Hook    func() `yaml:"-"`
+}
+
+func (c *hookCfg) GetVersion() int {
+	return c.Version
+}
+
+func (c *hookCfg) SetVersion(version int) {
+	c.Version = version
+}
+
+func (c *hookCfg) ApplyDefaults() {
+}
+
+func TestCopyFallsBackToYaml(t *testing.T) {
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &hookCfg{}
+		},
+	}
+	orig := &hookCfg{
+		Version: 3,
+		Items:   map[string]int{"a": 1},
+	}
+	copied, err := m.copy(orig)
+	if assert.NoError(t, err, "Copy should fall back to yaml") {
+		assert.Equal(t, orig, copied, "Copy should equal original")
+		copied.(*hookCfg).Items["a"] = 2
+		assert.Equal(t, 1, orig.Items["a"], "Copy should be deep")
+	}
+}
+
+func TestSharedEmptyConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	shared := &TestCfg{}
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return shared
+		},
+		FilePath: file.Name(),
+	}
+	_, err = m.Init()
+	assert.Error(t, err, "Init should fail if EmptyConfig returns the same config every time")
+}
+
+func TestDefaultConfigBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	starter := []byte("# Starter config\nversion: 1\nn:\n  # Pick something descriptive\n  s: starter\n  i: 55\n")
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath:           path,
+		DefaultConfigBytes: starter,
+	}
+	cfg, created, err := m.InitWithStatus()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer m.Stop()
+	assert.True(t, created, "Missing file should be reported as created")
+	assert.Equal(t, &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "starter",
+			I: FIXED_I,
+		},
+	}, cfg, "Config should be seeded from default bytes")
+	bod, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	assert.Equal(t, string(starter), string(bod), "Default bytes should be written as is")
+}
+
+func TestTreatEmptyAsMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	starter := []byte("version: 1\nn:\n  s: starter\n  i: 55\n")
+	expected := &TestCfg{
+		Version: 1,
+		N: &Nested{
+			S: "starter",
+			I: FIXED_I,
+		},
+	}
+	for name, placeholder := range map[string]string{"empty": "", "whitespace": "  \n\t\n"} {
+		path := filepath.Join(dir, name+".yaml")
+		if err := ioutil.WriteFile(path, []byte(placeholder), 0644); err != nil {
+			t.Fatalf("Unable to write placeholder: %s", err)
+		}
+		m := &Manager{
+			EmptyConfig: func() Config {
+				return &TestCfg{}
+			},
+			FilePath:            path,
+			DefaultConfigBytes:  starter,
+			TreatEmptyAsMissing: true,
+		}
+		cfg, created, err := m.InitWithStatus()
+		if err != nil {
+			t.Fatalf("Unable to init manager for %s file: %s", name, err)
+		}
+		assert.True(t, created, "%s file should be reported as created", name)
+		assert.Equal(t, expected, cfg, "%s file should be seeded from default bytes", name)
+		bod, err := ioutil.ReadFile(path)
+		if assert.NoError(t, err) {
+			assert.Equal(t, string(starter), string(bod), "%s file should be replaced with default bytes", name)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(placeholder), 0644); err != nil {
+			t.Fatalf("Unable to write placeholder: %s", err)
+		}
+		_, err = m.Reload()
+		assert.NoError(t, err, "Reloading %s file should succeed", name)
+		assert.Equal(t, expected, m.getCfg(), "Reloading %s file should keep current config", name)
+		bod, err = ioutil.ReadFile(path)
+		if assert.NoError(t, err) {
+			assert.Contains(t, string(bod), "s: starter", "%s file should be overwritten with current config", name)
+		}
+		m.Stop()
+	}
+
+	path := filepath.Join(dir, "without.json")
+	if err := ioutil.WriteFile(path, []byte(" \n"), 0644); err != nil {
+		t.Fatalf("Unable to write placeholder: %s", err)
+	}
+	m := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: path,
+	}
+	_, err = m.Init()
+	assert.Error(t, err, "Whitespace only file should fail to load without TreatEmptyAsMissing")
+}
+
+func TestLogger(t *testing.T) {
+	out := &lockedBuffer{}
+	golog.SetOutputs(out, out)
+	defer golog.ResetOutputs()
+
+	dir, err := ioutil.TempDir("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tenant := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: filepath.Join(dir, "tenant.yaml"),
+		Logger:   golog.LoggerFor("tenant-a"),
+	}
+	_, err = tenant.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer tenant.Stop()
+	assert.Contains(t, out.String(), "tenant-a: ", "Injected logger should be used")
+	assert.Contains(t, out.String(), "No config at "+tenant.FilePath)
+
+	global := &Manager{
+		EmptyConfig: func() Config {
+			return &TestCfg{}
+		},
+		FilePath: filepath.Join(dir, "global.yaml"),
+	}
+	_, err = global.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	defer global.Stop()
+	assert.Contains(t, out.String(), "yamlconf.global.yaml: ", "Default logger should be named after config file")
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, "No config at "+tenant.FilePath) {
+			assert.False(t, strings.Contains(line, "yamlconf.global.yaml"), "Managers should log separately: %s", line)
+		}
+	}
+}
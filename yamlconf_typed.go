@@ -0,0 +1,47 @@
+package yamlconf
+
+// TypedManager wraps a Manager whose configs are all of the concrete type T,
+// so that callers don't need to type-assert configs. All other methods are
+// those of the underlying Manager.
+type TypedManager[T Config] struct {
+	*Manager
+}
+
+// NewTypedManager wraps the given Manager, setting its EmptyConfig to
+// emptyConfig. The Manager still needs to be started with Init().
+func NewTypedManager[T Config](m *Manager, emptyConfig func() T) *TypedManager[T] {
+	m.EmptyConfig = func() Config {
+		return emptyConfig()
+	}
+	return &TypedManager[T]{m}
+}
+
+// Init is like Manager.Init.
+func (m *TypedManager[T]) Init() (T, error) {
+	cfg, err := m.Manager.Init()
+	return typed[T](cfg), err
+}
+
+// Next is like Manager.Next. Once the Manager has been stopped, it returns the
+// zero value of T.
+func (m *TypedManager[T]) Next() T {
+	return typed[T](m.Manager.Next())
+}
+
+// Current is like Manager.Current.
+func (m *TypedManager[T]) Current() T {
+	return typed[T](m.Manager.Current())
+}
+
+// Update is like Manager.Update.
+func (m *TypedManager[T]) Update(mutate func(cfg T) error) error {
+	return m.Manager.Update(func(cfg Config) error {
+		return mutate(cfg.(T))
+	})
+}
+
+// typed converts cfg to T, returning the zero value of T if cfg is nil.
+func typed[T Config](cfg Config) T {
+	t, _ := cfg.(T)
+	return t
+}
@@ -0,0 +1,45 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestTypedManager(t *testing.T) {
+	file, err := ioutil.TempFile("", "yamlconf_test_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			t.Fatalf("Unable to remove file: %s", err)
+		}
+	}()
+
+	m := NewTypedManager(&Manager{FilePath: file.Name()}, func() *TestCfg {
+		return &TestCfg{}
+	})
+	first, err := m.Init()
+	if err != nil {
+		t.Fatalf("Unable to init manager: %s", err)
+	}
+	assert.Equal(t, FIXED_I, first.N.I, "Initial config should be typed")
+
+	err = m.Update(func(cfg *TestCfg) error {
+		cfg.N.S = "typed"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to update: %s", err)
+	}
+	updated := m.Next()
+	assert.Equal(t, "typed", updated.N.S, "Next should return typed config")
+	assert.Equal(t, 2, updated.Version)
+	assert.Equal(t, "typed", m.Current().N.S, "Current should return typed config")
+
+	m.Stop()
+	assert.Nil(t, m.Next(), "Next should return nil once stopped")
+}
@@ -0,0 +1,100 @@
+package yamlconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/yaml"
+)
+
+// versionPath returns the path of the file in which the version is kept when
+// ExternalVersion is set.
+func (m *Manager) versionPath() string {
+	return m.FilePath + ".version"
+}
+
+// readExternalVersion reads the version from the version file, treating a
+// missing file as version 0.
+func (m *Manager) readExternalVersion() (int, error) {
+	data, err := ioutil.ReadFile(m.versionPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Unable to read version from %s: %s", m.versionPath(), err)
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid version in %s: %s", m.versionPath(), err)
+	}
+	return version, nil
+}
+
+func (m *Manager) writeExternalVersion(version int) error {
+	if err := ioutil.WriteFile(m.versionPath(), []byte(strconv.Itoa(version)+"\n"), m.FileMode); err != nil {
+		return fmt.Errorf("Unable to write version to %s: %s", m.versionPath(), err)
+	}
+	return nil
+}
+
+// marshalWithoutVersion marshals cfg, leaving out its version. Since the key
+// under which the version is marshaled depends on the Config, it's found by
+// marshaling the config with two different versions and dropping whichever
+// top-level key differs.
+func (m *Manager) marshalWithoutVersion(cfg Config) ([]byte, error) {
+	copied, err := m.copy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	copied.SetVersion(0)
+	withZero, err := m.marshal(copied)
+	if err != nil {
+		return nil, err
+	}
+	copied.SetVersion(1)
+	withOne, err := m.marshal(copied)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Format == FormatJSON {
+		var zero, one map[string]json.RawMessage
+		if err := json.Unmarshal(withZero, &zero); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(withOne, &one); err != nil {
+			return nil, err
+		}
+		for key, value := range zero {
+			if !bytes.Equal(value, one[key]) {
+				delete(zero, key)
+			}
+		}
+		return json.MarshalIndent(zero, "", "  ")
+	}
+
+	var zero, one yaml.MapSlice
+	if err := yaml.Unmarshal(withZero, &zero); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(withOne, &one); err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{}, len(one))
+	for _, item := range one {
+		values[item.Key] = item.Value
+	}
+	stripped := make(yaml.MapSlice, 0, len(zero))
+	for _, item := range zero {
+		if value, found := values[item.Key]; found && reflect.DeepEqual(item.Value, value) {
+			stripped = append(stripped, item)
+		}
+	}
+	return yaml.Marshal(stripped)
+}
@@ -0,0 +1,79 @@
+package yamlconf
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestExternalVersion(t *testing.T) {
+	for _, format := range []Format{FormatYAML, FormatJSON} {
+		file, err := ioutil.TempFile("", "yamlconf_test_")
+		if err != nil {
+			t.Fatalf("Unable to create temp file: %s", err)
+		}
+		defer os.Remove(file.Name())
+		defer os.Remove(file.Name() + ".version")
+
+		newManager := func() *Manager {
+			return &Manager{
+				EmptyConfig: func() Config {
+					return &TestCfg{}
+				},
+				FilePath:        file.Name(),
+				Format:          format,
+				ExternalVersion: true,
+			}
+		}
+		m := newManager()
+		_, err = m.Init()
+		if err != nil {
+			t.Fatalf("Unable to init manager: %s", err)
+		}
+		err = m.Update(func(cfg Config) error {
+			cfg.(*TestCfg).N.S = "external"
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+		m.Stop()
+
+		bod, err := ioutil.ReadFile(file.Name())
+		if assert.NoError(t, err) {
+			assert.True(t, strings.Contains(string(bod), "external"), "%v: Config should be saved", format)
+			assert.False(t, strings.Contains(strings.ToLower(string(bod)), "version"), "%v: Version should not be saved in config: %s", format, bod)
+		}
+		version, err := ioutil.ReadFile(file.Name() + ".version")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "2\n", string(version), "%v: Version should be saved separately", format)
+		}
+
+		m = newManager()
+		cfg, err := m.Init()
+		if assert.NoError(t, err) {
+			assert.Equal(t, &TestCfg{
+				Version: 2,
+				N: &Nested{
+					S: "external",
+					I: FIXED_I,
+				},
+			}, cfg, "%v: Version should be read from version file", format)
+			m.Stop()
+		}
+
+		if err := os.Remove(file.Name() + ".version"); err != nil {
+			t.Fatalf("Unable to remove version file: %s", err)
+		}
+		m = newManager()
+		cfg, err = m.Init()
+		if assert.NoError(t, err) {
+			assert.Equal(t, 0, cfg.GetVersion(), "%v: Missing version file should mean version 0", format)
+			assert.Equal(t, "external", cfg.(*TestCfg).N.S)
+			m.Stop()
+		}
+	}
+}
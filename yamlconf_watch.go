@@ -0,0 +1,111 @@
+package yamlconf
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFile starts watching FilePath and any other files it's merged with
+// (and FragmentDir, if applicable) for changes. Rather than the files
+// themselves, the directories containing them are watched, since editors
+// commonly save by moving the original out of the way and creating a new
+// file, which would drop a watch on the file.
+func (m *Manager) watchFile() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.watchPaths(watcher); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	if m.FragmentDir != "" {
+		if err := watcher.Add(m.FragmentDir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	m.watchIncludes(watcher)
+	return watcher, nil
+}
+
+// handleFileEvent handles the given event, making sure that everything
+// remains watched. It returns true if the event concerns the config, in which
+// case the caller is responsible for reloading.
+func (m *Manager) handleFileEvent(event fsnotify.Event) bool {
+	m.logger().Tracef("File event: %v", event)
+	if event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+		// Included files are watched directly, and replacing them drops the
+		// watch on the old file, so watch the new one.
+		m.watchIncludes(m.watcher)
+	}
+	if !m.isWatched(event.Name) {
+		return false
+	}
+	if m.FollowSymlinks {
+		// The symlink may have been swapped to a file in another directory
+		if err := m.watchPaths(m.watcher); err != nil {
+			m.reportError(sourceDisk, fmt.Errorf("Unable to resume watching: %s", err))
+		}
+	}
+	return true
+}
+
+// watchPaths adds the directories containing all files that make up the
+// config (see watchedPaths) to the given watcher.
+func (m *Manager) watchPaths(watcher *fsnotify.Watcher) error {
+	paths, err := m.watchedPaths()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("Unable to watch %s: %s", dir, err)
+		}
+	}
+	return nil
+}
+
+// watchedPaths returns the paths of all files that make up the config,
+// including the file that FilePath points to if FollowSymlinks is set.
+func (m *Manager) watchedPaths() ([]string, error) {
+	paths, err := m.filePaths()
+	if err != nil {
+		return nil, err
+	}
+	if m.FollowSymlinks {
+		if target, err := filepath.EvalSymlinks(m.FilePath); err == nil && target != m.FilePath {
+			paths = append(paths, target)
+		}
+	}
+	return paths, nil
+}
+
+// isWatched checks whether the file at the given path is part of the config,
+// as opposed to some other file in a watched directory.
+func (m *Manager) isWatched(name string) bool {
+	name = filepath.Clean(name)
+	if m.FragmentDir != "" && filepath.Dir(name) == filepath.Clean(m.FragmentDir) && filepath.Ext(name) == ".yaml" {
+		// Includes fragments that were just added or removed
+		return true
+	}
+	paths, err := m.watchedPaths()
+	if err != nil {
+		// Err on the side of reloading
+		return true
+	}
+	for _, path := range append(paths, m.includes...) {
+		if filepath.Clean(path) == name {
+			return true
+		}
+	}
+	return false
+}